@@ -0,0 +1,64 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker stops calls to a failing service for Cooldown once Threshold
+// consecutive calls failed. After the cooldown calls are let through again and
+// the first failure re-opens the circuit.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Allow tells whether a call should be made.
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.Threshold {
+		return true
+	}
+
+	return b.currentTime().Sub(b.openedAt) >= b.Cooldown
+}
+
+// Success records a successful call, closing the circuit.
+func (b *CircuitBreaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+}
+
+// Failure records a failed call, opening the circuit when the threshold is
+// reached.
+func (b *CircuitBreaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+
+	if b.failures >= b.Threshold {
+		b.openedAt = b.currentTime()
+	}
+}
+
+func (b *CircuitBreaker) currentTime() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+
+	return b.now()
+}
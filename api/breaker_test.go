@@ -0,0 +1,47 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &fakeClock{time.Unix(1400000000, 0)}
+	breaker := NewCircuitBreaker(3, 10*time.Second)
+	breaker.now = clock.now
+
+	breaker.Failure()
+	breaker.Failure()
+	breaker.Success()
+	breaker.Failure()
+	breaker.Failure()
+
+	if !breaker.Allow() {
+		t.Errorf("expected circuit to be closed after 2 consecutive failures")
+	}
+
+	breaker.Failure()
+
+	if breaker.Allow() {
+		t.Errorf("expected circuit to be open after 3 consecutive failures")
+	}
+
+	clock.t = clock.t.Add(10 * time.Second)
+
+	if !breaker.Allow() {
+		t.Errorf("expected circuit to let calls through after cooldown")
+	}
+
+	breaker.Failure()
+
+	if breaker.Allow() {
+		t.Errorf("expected circuit to be re-opened after failure following cooldown")
+	}
+
+	clock.t = clock.t.Add(10 * time.Second)
+	breaker.Success()
+
+	if !breaker.Allow() {
+		t.Errorf("expected circuit to be closed after success")
+	}
+}
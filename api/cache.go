@@ -0,0 +1,178 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type repoConfigKey struct {
+	repoPath string
+	username string
+}
+
+type repoConfigEntry struct {
+	repoConfig *RepoConfig
+	err        error
+	expiresAt  time.Time
+}
+
+// CachingInternalApi is an InternalApi decorator caching repository configs
+// returned by the wrapped api, per repository path and username. Successful
+// responses are cached for ttl, "not found" responses for negativeTtl, other
+// errors are not cached at all.
+type CachingInternalApi struct {
+	api         InternalApi
+	ttl         time.Duration
+	negativeTtl time.Duration
+	now         func() time.Time
+
+	mutex     sync.Mutex
+	entries   map[repoConfigKey]*repoConfigEntry
+	lastSweep time.Time
+}
+
+func NewCachingInternalApi(api InternalApi, ttl, negativeTtl time.Duration) *CachingInternalApi {
+	return &CachingInternalApi{
+		api:         api,
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		now:         time.Now,
+		entries:     make(map[repoConfigKey]*repoConfigEntry),
+	}
+}
+
+func (a *CachingInternalApi) GetRepoConfig(repoPath, username string) (*RepoConfig, error) {
+	key := repoConfigKey{repoPath, username}
+
+	if entry := a.get(key); entry != nil {
+		return copyRepoConfig(entry.repoConfig), entry.err
+	}
+
+	repoConfig, err := a.api.GetRepoConfig(repoPath, username)
+
+	if err == nil {
+		a.set(key, &repoConfigEntry{repoConfig: copyRepoConfig(repoConfig)}, a.ttl)
+	} else if httpErr, ok := err.(*HttpError); ok && httpErr.StatusCode == 404 {
+		a.set(key, &repoConfigEntry{err: err}, a.negativeTtl)
+	}
+
+	return repoConfig, err
+}
+
+func (a *CachingInternalApi) AuthenticateUser(username, password string) (*User, error) {
+	return a.api.AuthenticateUser(username, password)
+}
+
+func (a *CachingInternalApi) AuthenticateToken(token string) (*AccessToken, error) {
+	return a.api.AuthenticateToken(token)
+}
+
+// Invalidate drops cached config of the given repository for the given user.
+func (a *CachingInternalApi) Invalidate(repoPath, username string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.entries, repoConfigKey{repoPath, username})
+}
+
+// InvalidateRepo drops cached configs of the given repository for all users.
+func (a *CachingInternalApi) InvalidateRepo(repoPath string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for key := range a.entries {
+		if key.repoPath == repoPath {
+			delete(a.entries, key)
+		}
+	}
+}
+
+// InvalidateAll drops all cached configs.
+func (a *CachingInternalApi) InvalidateAll() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.entries = make(map[repoConfigKey]*repoConfigEntry)
+}
+
+// InvalidationHandler drops cached configs on POST requests: of a repository
+// for a user (repo_path and username parameters), of a repository for all
+// users (repo_path only) or all of them (no parameters). It lets changes like
+// revoked access or renamed repository take effect right away.
+func (a *CachingInternalApi) InvalidationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		repoPath := req.FormValue("repo_path")
+		username := req.FormValue("username")
+
+		switch {
+		case repoPath == "" && username != "":
+			http.Error(w, "username requires repo_path", http.StatusBadRequest)
+			return
+		case repoPath == "":
+			a.InvalidateAll()
+		case username == "":
+			a.InvalidateRepo(repoPath)
+		default:
+			a.Invalidate(repoPath, username)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (a *CachingInternalApi) get(key repoConfigKey) *repoConfigEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	entry, ok := a.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if !a.now().Before(entry.expiresAt) {
+		delete(a.entries, key)
+		return nil
+	}
+
+	return entry
+}
+
+func (a *CachingInternalApi) set(key repoConfigKey, entry *repoConfigEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.now()
+	entry.expiresAt = now.Add(ttl)
+	a.entries[key] = entry
+
+	// drop expired entries from time to time so the cache doesn't grow forever
+	if now.Sub(a.lastSweep) > a.ttl {
+		for key, entry := range a.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(a.entries, key)
+			}
+		}
+
+		a.lastSweep = now
+	}
+}
+
+func copyRepoConfig(repoConfig *RepoConfig) *RepoConfig {
+	if repoConfig == nil {
+		return nil
+	}
+
+	c := *repoConfig
+	return &c
+}
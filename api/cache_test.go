@@ -0,0 +1,197 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countingInternalApi struct {
+	calls int
+	err   error
+}
+
+func (a *countingInternalApi) GetRepoConfig(repoPath, username string) (*RepoConfig, error) {
+	a.calls++
+
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	return &RepoConfig{RepositoryId: a.calls, FullPath: "/repos/" + repoPath}, nil
+}
+
+func (a *countingInternalApi) AuthenticateUser(username, password string) (*User, error) {
+	a.calls++
+	return &User{Username: username}, nil
+}
+
+func (a *countingInternalApi) AuthenticateToken(token string) (*AccessToken, error) {
+	a.calls++
+	return &AccessToken{Username: "sickill", Scopes: []TokenScope{ScopeRead}}, nil
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestCache(api InternalApi, ttl, negativeTtl time.Duration) (*CachingInternalApi, *fakeClock) {
+	clock := &fakeClock{time.Unix(1400000000, 0)}
+	cache := NewCachingInternalApi(api, ttl, negativeTtl)
+	cache.now = clock.now
+
+	return cache, clock
+}
+
+func TestCachingInternalApi_GetRepoConfig(t *testing.T) {
+	backend := &countingInternalApi{}
+	cache, clock := newTestCache(backend, 10*time.Second, time.Second)
+
+	repoConfig, _ := cache.GetRepoConfig("foo/bar.git", "sickill")
+	repoConfig.FullPath = "/modified"
+
+	repoConfig, _ = cache.GetRepoConfig("foo/bar.git", "sickill")
+	if backend.calls != 1 {
+		t.Errorf("expected 1 call to the api, got %v", backend.calls)
+	}
+	if repoConfig.FullPath != "/repos/foo/bar.git" {
+		t.Errorf("expected cached config not to be affected by callers, got %v", repoConfig.FullPath)
+	}
+
+	cache.GetRepoConfig("foo/bar.git", "")
+	cache.GetRepoConfig("foo/baz.git", "sickill")
+	if backend.calls != 3 {
+		t.Errorf("expected separate entries per repo path and username, got %v calls", backend.calls)
+	}
+
+	clock.t = clock.t.Add(10 * time.Second)
+
+	repoConfig, _ = cache.GetRepoConfig("foo/bar.git", "sickill")
+	if backend.calls != 4 || repoConfig.RepositoryId != 4 {
+		t.Errorf("expected expired entry to be refetched, got %v calls", backend.calls)
+	}
+}
+
+func TestCachingInternalApi_GetRepoConfig_Errors(t *testing.T) {
+	var tests = []struct {
+		err           error
+		expectedCalls int
+	}{
+		{&HttpError{Url: &url.URL{Path: "/repo-config"}, StatusCode: 404}, 1},
+		{&HttpError{Url: &url.URL{Path: "/repo-config"}, StatusCode: 403}, 2},
+		{&HttpError{Url: &url.URL{Path: "/repo-config"}, StatusCode: 500}, 2},
+		{errors.New("connection refused"), 2},
+	}
+
+	for _, test := range tests {
+		backend := &countingInternalApi{err: test.err}
+		cache, clock := newTestCache(backend, 10*time.Second, time.Second)
+
+		cache.GetRepoConfig("foo/bar.git", "sickill")
+		_, err := cache.GetRepoConfig("foo/bar.git", "sickill")
+
+		if err != test.err {
+			t.Errorf("expected error %v, got %v", test.err, err)
+		}
+
+		if backend.calls != test.expectedCalls {
+			t.Errorf("expected %v calls to the api, got %v (%v)", test.expectedCalls, backend.calls, test.err)
+		}
+
+		clock.t = clock.t.Add(time.Second)
+		cache.GetRepoConfig("foo/bar.git", "sickill")
+
+		if backend.calls != test.expectedCalls+1 {
+			t.Errorf("expected negative entry to expire after 1s (%v)", test.err)
+		}
+	}
+}
+
+func TestCachingInternalApi_Invalidate(t *testing.T) {
+	backend := &countingInternalApi{}
+	cache, _ := newTestCache(backend, 10*time.Second, time.Second)
+
+	cache.GetRepoConfig("foo/bar.git", "sickill")
+	cache.GetRepoConfig("foo/bar.git", "")
+	cache.GetRepoConfig("foo/baz.git", "sickill")
+
+	cache.Invalidate("foo/bar.git", "sickill")
+	cache.GetRepoConfig("foo/bar.git", "sickill")
+	cache.GetRepoConfig("foo/bar.git", "")
+	if backend.calls != 4 {
+		t.Errorf("expected only invalidated entry to be refetched, got %v calls", backend.calls)
+	}
+
+	cache.InvalidateRepo("foo/bar.git")
+	cache.GetRepoConfig("foo/bar.git", "sickill")
+	cache.GetRepoConfig("foo/bar.git", "")
+	cache.GetRepoConfig("foo/baz.git", "sickill")
+	if backend.calls != 6 {
+		t.Errorf("expected all entries of invalidated repo to be refetched, got %v calls", backend.calls)
+	}
+
+	cache.InvalidateAll()
+	cache.GetRepoConfig("foo/baz.git", "sickill")
+	if backend.calls != 7 {
+		t.Errorf("expected all entries to be refetched, got %v calls", backend.calls)
+	}
+}
+
+func TestCachingInternalApi_InvalidationHandler(t *testing.T) {
+	var tests = []struct {
+		method         string
+		body           string
+		expectedStatus int
+		expectedCalls  int // after fetching both cached configs again
+	}{
+		{"POST", "repo_path=foo%2Fbar.git&username=sickill", 204, 3},
+		{"POST", "repo_path=foo%2Fbar.git", 204, 4},
+		{"POST", "", 204, 4},
+		{"POST", "username=sickill", 400, 2},
+		{"GET", "", 405, 2},
+	}
+
+	for _, test := range tests {
+		backend := &countingInternalApi{}
+		cache, _ := newTestCache(backend, 10*time.Second, time.Second)
+
+		cache.GetRepoConfig("foo/bar.git", "sickill")
+		cache.GetRepoConfig("foo/bar.git", "ajax")
+
+		req := httptest.NewRequest(test.method, "/cache/invalidate", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		cache.InvalidationHandler().ServeHTTP(w, req)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+
+		cache.GetRepoConfig("foo/bar.git", "sickill")
+		cache.GetRepoConfig("foo/bar.git", "ajax")
+
+		if backend.calls != test.expectedCalls {
+			t.Errorf("expected %v calls to the api, got %v (%v)", test.expectedCalls, backend.calls, test)
+		}
+	}
+}
+
+func TestCachingInternalApi_AuthenticateUser(t *testing.T) {
+	backend := &countingInternalApi{}
+	cache, _ := newTestCache(backend, 10*time.Second, time.Second)
+
+	cache.AuthenticateUser("sickill", "xxx")
+	cache.AuthenticateUser("sickill", "xxx")
+
+	if backend.calls != 2 {
+		t.Errorf("expected authentication not to be cached, got %v calls", backend.calls)
+	}
+}
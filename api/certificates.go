@@ -0,0 +1,33 @@
+package api
+
+// CertificatesApi is the part of the internal API used for authenticating
+// users with TLS client certificates.
+type CertificatesApi interface {
+	FindCertificateUser(subject string) (*User, error)
+}
+
+// FindCertificateUser returns the user a client certificate with the given
+// subject (like "CN=sickill,O=Gitorious") belongs to. It returns nil user
+// when the subject isn't mapped to any.
+func (a *GitoriousInternalApi) FindCertificateUser(subject string) (*User, error) {
+	u, err := a.endpoint("/certificate-user")
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("subject", subject)
+	u.RawQuery = q.Encode()
+
+	var user User
+
+	if err := a.getJson(u, &user); err != nil {
+		if httpErr, ok := err.(*HttpError); ok && httpErr.StatusCode == 404 {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitoriousInternalApi_FindCertificateUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/certificate-user" || req.URL.Query().Get("subject") != "CN=sickill,O=Gitorious" {
+			w.WriteHeader(404)
+			return
+		}
+
+		fmt.Fprintf(w, `{"username": "sickill"}`)
+	}))
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	user, err := a.FindCertificateUser("CN=sickill,O=Gitorious")
+	if err != nil || user == nil || user.Username != "sickill" {
+		t.Errorf("unexpected user %+v (error: %v)", user, err)
+	}
+
+	user, err = a.FindCertificateUser("CN=nobody,O=Gitorious")
+	if err != nil || user != nil {
+		t.Errorf("expected no user and no error for unknown subject, got %+v (error: %v)", user, err)
+	}
+}
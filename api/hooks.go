@@ -0,0 +1,148 @@
+package api
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type RefUpdate struct {
+	Refname   string `json:"refname"`
+	OldSha    string `json:"oldsha"`
+	NewSha    string `json:"newsha"`
+	MergeBase string `json:"mergebase"`
+}
+
+// PushRejectedError is returned when a push is not authorized. Message is meant
+// to be shown to the user.
+type PushRejectedError struct {
+	Message string
+}
+
+func (e *PushRejectedError) Error() string {
+	return "push rejected: " + e.Message
+}
+
+// PushEvent describes a completed push. Id is unique per event and stays the
+// same across delivery attempts, so the app can ignore duplicates.
+type PushEvent struct {
+	Id           string      `json:"id"`
+	Username     string      `json:"username"`
+	RepositoryId int         `json:"repository_id"`
+	PushedAt     time.Time   `json:"pushed_at"`
+	Refs         []RefUpdate `json:"refs"`
+}
+
+// HooksApi is the part of the internal API used by git hooks.
+type HooksApi interface {
+	AuthorizePush(username string, repositoryId int, refs []RefUpdate) error
+	NotifyPush(event *PushEvent) error
+}
+
+type pushAuthorizationRequest struct {
+	Username     string      `json:"username"`
+	RepositoryId int         `json:"repository_id"`
+	Refs         []RefUpdate `json:"refs"`
+}
+
+// isNotSupported tells whether err means the endpoint doesn't exist in this
+// Gitorious version.
+func isNotSupported(err error) bool {
+	httpErr, ok := err.(*HttpError)
+	return ok && (httpErr.StatusCode == 404 || httpErr.StatusCode == 405)
+}
+
+func pushRejected(err error) error {
+	if httpErr, ok := err.(*HttpError); ok && httpErr.StatusCode == 403 {
+		return &PushRejectedError{httpErr.Message}
+	}
+
+	return err
+}
+
+// AuthorizePush checks whether all the given refs may be updated by the user,
+// with a single request. Older Gitorious versions, without the batch
+// endpoint, are asked about each ref separately.
+func (a *GitoriousInternalApi) AuthorizePush(username string, repositoryId int, refs []RefUpdate) error {
+	u, err := a.endpoint("/hooks/pre-receive-batch")
+	if err != nil {
+		return err
+	}
+
+	payload := &pushAuthorizationRequest{username, repositoryId, refs}
+
+	err = a.postJson(u, payload, nil)
+	if isNotSupported(err) {
+		return a.authorizeRefs(username, repositoryId, refs)
+	}
+
+	return pushRejected(err)
+}
+
+// authorizeRefs authorizes refs one by one, with GET requests with query
+// parameters, like the pre-receive hook of older Gitorious versions did.
+func (a *GitoriousInternalApi) authorizeRefs(username string, repositoryId int, refs []RefUpdate) error {
+	for _, ref := range refs {
+		u, err := a.endpoint("/hooks/pre-receive")
+		if err != nil {
+			return err
+		}
+
+		q := u.Query()
+		q.Set("username", username)
+		q.Set("repository_id", strconv.Itoa(repositoryId))
+		q.Set("refname", ref.Refname)
+		q.Set("oldsha", ref.OldSha)
+		q.Set("newsha", ref.NewSha)
+		q.Set("mergebase", ref.MergeBase)
+		u.RawQuery = q.Encode()
+
+		if err := a.getJson(u, nil); err != nil {
+			return pushRejected(err)
+		}
+	}
+
+	return nil
+}
+
+// NotifyPush lets the app know about a completed push. Older Gitorious
+// versions, without the batch endpoint, are notified about each ref
+// separately.
+func (a *GitoriousInternalApi) NotifyPush(event *PushEvent) error {
+	u, err := a.endpoint("/hooks/post-receive-batch")
+	if err != nil {
+		return err
+	}
+
+	err = a.postJson(u, event, nil)
+	if isNotSupported(err) {
+		return a.notifyRefs(event)
+	}
+
+	return err
+}
+
+// notifyRefs sends a form POST per ref, like the post-receive hook of older
+// Gitorious versions did. These versions don't know about event ids, so refs
+// notified before a failure are notified again when the event is retried.
+func (a *GitoriousInternalApi) notifyRefs(event *PushEvent) error {
+	for _, ref := range event.Refs {
+		u, err := a.endpoint("/hooks/post-receive")
+		if err != nil {
+			return err
+		}
+
+		form := url.Values{}
+		form.Set("username", event.Username)
+		form.Set("repository_id", strconv.Itoa(event.RepositoryId))
+		form.Set("refname", ref.Refname)
+		form.Set("oldsha", ref.OldSha)
+		form.Set("newsha", ref.NewSha)
+
+		if err := a.postForm(u, form, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitoriousInternalApi_AuthorizePush(t *testing.T) {
+	var received pushAuthorizationRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = pushAuthorizationRequest{}
+		json.NewDecoder(req.Body).Decode(&received)
+
+		if req.Method != "POST" || req.URL.Path != "/hooks/pre-receive-batch" {
+			w.WriteHeader(404)
+			return
+		}
+
+		for _, ref := range received.Refs {
+			if ref.Refname == "refs/heads/master" {
+				w.WriteHeader(403)
+				w.Write([]byte("You can't push to master.\nPlease use merge requests."))
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	refs := []RefUpdate{
+		{"refs/heads/feature", "0000000000000000000000000000000000000000", "b506db4d7520f0257dfe389ab729fa0976ced289", ""},
+		{"refs/heads/fix", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c", "19df9a1b5c973b004f23f7989ce2773ba638acd9", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c"},
+	}
+
+	if err := a.AuthorizePush("sickill", 123, refs); err != nil {
+		t.Errorf("expected push to be authorized, got %v", err)
+	}
+
+	if received.Username != "sickill" || received.RepositoryId != 123 || len(received.Refs) != 2 || received.Refs[1] != refs[1] {
+		t.Errorf("unexpected request payload %+v", received)
+	}
+
+	refs = append(refs, RefUpdate{"refs/heads/master", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c", "19df9a1b5c973b004f23f7989ce2773ba638acd9", ""})
+
+	err := a.AuthorizePush("sickill", 123, refs)
+
+	expectedMessage := "You can't push to master.\nPlease use merge requests."
+	if rejectedErr, ok := err.(*PushRejectedError); !ok || rejectedErr.Message != expectedMessage {
+		t.Errorf("expected PushRejectedError with message %q, got %v", expectedMessage, err)
+	}
+}
+
+func TestGitoriousInternalApi_AuthorizePush_Legacy(t *testing.T) {
+	var requests []string
+
+	// like older Gitorious versions, asked by the shell pre-receive hook
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" || req.URL.Path != "/hooks/pre-receive" {
+			w.WriteHeader(404)
+			return
+		}
+
+		q := req.URL.Query()
+		requests = append(requests, strings.Join([]string{q.Get("username"), q.Get("repository_id"), q.Get("refname"), q.Get("oldsha"), q.Get("newsha"), q.Get("mergebase")}, " "))
+
+		if q.Get("refname") == "refs/heads/master" {
+			w.WriteHeader(403)
+			w.Write([]byte("You can't push to master."))
+		}
+	}))
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	refs := []RefUpdate{
+		{"refs/heads/feature", "0000000000000000000000000000000000000000", "b506db4d7520f0257dfe389ab729fa0976ced289", ""},
+		{"refs/heads/fix", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c", "19df9a1b5c973b004f23f7989ce2773ba638acd9", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c"},
+	}
+
+	if err := a.AuthorizePush("sickill", 123, refs); err != nil {
+		t.Errorf("expected push to be authorized, got %v", err)
+	}
+
+	expected := []string{
+		"sickill 123 refs/heads/feature 0000000000000000000000000000000000000000 b506db4d7520f0257dfe389ab729fa0976ced289 ",
+		"sickill 123 refs/heads/fix 5577de353b5799f4c7bd65561b630c4cc8eb4b1c 19df9a1b5c973b004f23f7989ce2773ba638acd9 5577de353b5799f4c7bd65561b630c4cc8eb4b1c",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected a request per ref %q, got %q", expected, requests)
+	}
+
+	refs = append(refs, RefUpdate{"refs/heads/master", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c", "19df9a1b5c973b004f23f7989ce2773ba638acd9", ""})
+
+	err := a.AuthorizePush("sickill", 123, refs)
+
+	if rejectedErr, ok := err.(*PushRejectedError); !ok || rejectedErr.Message != "You can't push to master." {
+		t.Errorf("expected PushRejectedError, got %v", err)
+	}
+}
+
+func TestGitoriousInternalApi_NotifyPush(t *testing.T) {
+	var received PushEvent
+
+	statuses := []int{200, 503}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = PushEvent{}
+		json.NewDecoder(req.Body).Decode(&received)
+
+		if req.Method != "POST" || req.URL.Path != "/hooks/post-receive-batch" {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+	a.MaxRetries = 0
+
+	event := &PushEvent{
+		Id:           "1400000000000000000-abcdef",
+		Username:     "sickill",
+		RepositoryId: 123,
+		PushedAt:     time.Unix(1400000000, 0).UTC(),
+		Refs:         []RefUpdate{{"refs/heads/master", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c", "19df9a1b5c973b004f23f7989ce2773ba638acd9", ""}},
+	}
+
+	if err := a.NotifyPush(event); err != nil {
+		t.Errorf("expected event to be accepted, got %v", err)
+	}
+
+	if received.Id != event.Id || received.Username != "sickill" || received.RepositoryId != 123 || !received.PushedAt.Equal(event.PushedAt) || len(received.Refs) != 1 || received.Refs[0] != event.Refs[0] {
+		t.Errorf("unexpected request payload %+v", received)
+	}
+
+	if _, ok := a.NotifyPush(event).(*UnavailableError); !ok {
+		t.Errorf("expected UnavailableError for 503 response")
+	}
+}
+
+func TestGitoriousInternalApi_NotifyPush_Legacy(t *testing.T) {
+	var requests []string
+
+	// like older Gitorious versions, notified by the shell post-receive hook
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/hooks/post-receive" {
+			w.WriteHeader(404)
+			return
+		}
+
+		requests = append(requests, strings.Join([]string{req.FormValue("username"), req.FormValue("repository_id"), req.FormValue("refname"), req.FormValue("oldsha"), req.FormValue("newsha")}, " "))
+	}))
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	event := &PushEvent{
+		Id:           "1400000000000000000-abcdef",
+		Username:     "sickill",
+		RepositoryId: 123,
+		Refs: []RefUpdate{
+			{"refs/heads/master", "5577de353b5799f4c7bd65561b630c4cc8eb4b1c", "19df9a1b5c973b004f23f7989ce2773ba638acd9", ""},
+			{"refs/heads/feature", "0000000000000000000000000000000000000000", "b506db4d7520f0257dfe389ab729fa0976ced289", ""},
+		},
+	}
+
+	if err := a.NotifyPush(event); err != nil {
+		t.Errorf("expected event to be accepted, got %v", err)
+	}
+
+	expected := []string{
+		"sickill 123 refs/heads/master 5577de353b5799f4c7bd65561b630c4cc8eb4b1c 19df9a1b5c973b004f23f7989ce2773ba638acd9",
+		"sickill 123 refs/heads/feature 0000000000000000000000000000000000000000 b506db4d7520f0257dfe389ab729fa0976ced289",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected a request per ref %q, got %q", expected, requests)
+	}
+}
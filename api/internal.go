@@ -1,15 +1,38 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
+type AccessLevel string
+
+const (
+	AccessUnknown AccessLevel = "" // not reported by older Gitorious versions
+	AccessRead    AccessLevel = "read"
+	AccessWrite   AccessLevel = "write"
+	AccessAdmin   AccessLevel = "admin"
+)
+
+func (l AccessLevel) CanWrite() bool {
+	return l == AccessWrite || l == AccessAdmin
+}
+
 type RepoConfig struct {
-	RepositoryId int    `json:"repository_id"`
-	FullPath     string `json:"full_path"`
+	RepositoryId int         `json:"repository_id"`
+	FullPath     string      `json:"full_path"`
+	AccessLevel  AccessLevel `json:"access_level"`
 
 	SshCloneUrl  string `json:"ssh_clone_url"`
 	HttpCloneUrl string `json:"http_clone_url"`
@@ -20,30 +43,135 @@ type RepoConfig struct {
 	CustomUpdatePath      string `json:"custom_update_path"`
 }
 
+// WriteDenied tells whether the user is known not to have write access to the
+// repository. When access level is unknown pushes are authorized by
+// pre-receive hook only.
+func (c *RepoConfig) WriteDenied() bool {
+	return c.AccessLevel != AccessUnknown && !c.AccessLevel.CanWrite()
+}
+
 type User struct {
 	Username string `json:"username"`
 }
 
+type TokenScope string
+
+const (
+	ScopeRead  TokenScope = "read"
+	ScopeWrite TokenScope = "write"
+)
+
+// AccessToken describes a personal access token: who it belongs to and what
+// it can be used for.
+type AccessToken struct {
+	Username string       `json:"username"`
+	Scopes   []TokenScope `json:"scopes"`
+}
+
+func (t *AccessToken) HasScope(scope TokenScope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allows tells whether the token can be used for a push (or a fetch when
+// isPush is false). Write scope implies read.
+func (t *AccessToken) Allows(isPush bool) bool {
+	if isPush {
+		return t.HasScope(ScopeWrite)
+	}
+
+	return t.HasScope(ScopeRead) || t.HasScope(ScopeWrite)
+}
+
 type InternalApi interface {
 	GetRepoConfig(string, string) (*RepoConfig, error)
 	AuthenticateUser(string, string) (*User, error)
+	AuthenticateToken(string) (*AccessToken, error)
 }
 
 type HttpError struct {
 	Url        *url.URL
 	StatusCode int
+	Message    string // response body
 }
 
 func (e *HttpError) Error() string {
 	return fmt.Sprintf("got HTTP status %v for %v", e.StatusCode, e.Url)
 }
 
+// UnavailableError is returned when the internal API can't be reached or
+// reports being unavailable (HTTP 502, 503, 504), and when the circuit breaker
+// stops calls to it.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("internal API unavailable: %v", e.Err)
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultReadTimeout    = 30 * time.Second
+	DefaultMaxRetries     = 2
+	DefaultRetryBackoff   = 200 * time.Millisecond
+)
+
+const maxErrorMessageLength = 64 * 1024
+
+const (
+	unixSocketScheme = "unix://"
+	unixSocketPath   = "/api/internal"
+)
+
 type GitoriousInternalApi struct {
+	// ApiUrl is either HTTP(S) URL of the API or "unix://" followed by a path
+	// to unix domain socket, in which case the API is expected at
+	// "/api/internal" path.
 	ApiUrl string
+
+	ConnectTimeout time.Duration // zero means no timeout
+	ReadTimeout    time.Duration // zero means no timeout
+
+	// GET requests failing with unavailability errors are retried up to
+	// MaxRetries times, waiting RetryBackoff before the first retry and twice
+	// as long before each next one.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	Breaker *CircuitBreaker // optional
+
+	// SigningKey, when set, is used to sign all requests (see SignRequest).
+	SigningKey []byte
+
+	// LegacyAuthentication makes AuthenticateUser send credentials in a query
+	// string of GET request, for Gitorious versions not accepting POST.
+	LegacyAuthentication bool
+
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+func NewGitoriousInternalApi(apiUrl string) *GitoriousInternalApi {
+	return &GitoriousInternalApi{
+		ApiUrl:         apiUrl,
+		ConnectTimeout: DefaultConnectTimeout,
+		ReadTimeout:    DefaultReadTimeout,
+		MaxRetries:     DefaultMaxRetries,
+		RetryBackoff:   DefaultRetryBackoff,
+		Breaker:        NewCircuitBreaker(5, 30*time.Second),
+	}
 }
 
 func (a *GitoriousInternalApi) GetRepoConfig(repoPath, username string) (*RepoConfig, error) {
-	u, err := url.Parse(a.ApiUrl + "/repo-config")
+	u, err := a.endpoint("/repo-config")
 	if err != nil {
 		return nil, err
 	}
@@ -63,19 +191,25 @@ func (a *GitoriousInternalApi) GetRepoConfig(repoPath, username string) (*RepoCo
 }
 
 func (a *GitoriousInternalApi) AuthenticateUser(username, password string) (*User, error) {
-	u, err := url.Parse(a.ApiUrl + "/authenticate")
+	u, err := a.endpoint("/authenticate")
 	if err != nil {
 		return nil, err
 	}
 
-	q := u.Query()
-	q.Set("username", username)
-	q.Set("password", password)
-	u.RawQuery = q.Encode()
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", password)
 
 	var user User
 
-	if err := a.getJson(u, &user); err != nil {
+	if a.LegacyAuthentication {
+		u.RawQuery = form.Encode()
+		err = a.getJson(u, &user)
+	} else {
+		err = a.postForm(u, form, &user)
+	}
+
+	if err != nil {
 		if httpErr, ok := err.(*HttpError); ok {
 			if httpErr.StatusCode == 401 {
 				return nil, nil
@@ -88,23 +222,174 @@ func (a *GitoriousInternalApi) AuthenticateUser(username, password string) (*Use
 	return &user, nil
 }
 
+// AuthenticateToken returns the personal access token, or nil when it's
+// invalid (unknown, expired or revoked) or Gitorious doesn't support tokens.
+func (a *GitoriousInternalApi) AuthenticateToken(token string) (*AccessToken, error) {
+	u, err := a.endpoint("/authenticate-token")
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("token", token)
+
+	var accessToken AccessToken
+
+	if err := a.postForm(u, form, &accessToken); err != nil {
+		// older Gitorious versions have no such endpoint
+		if httpErr, ok := err.(*HttpError); ok && (httpErr.StatusCode == 401 || httpErr.StatusCode == 404) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &accessToken, nil
+}
+
+func (a *GitoriousInternalApi) endpoint(path string) (*url.URL, error) {
+	if strings.HasPrefix(a.ApiUrl, unixSocketScheme) {
+		return url.Parse("http://unix" + unixSocketPath + path)
+	}
+
+	return url.Parse(a.ApiUrl + path)
+}
+
+func (a *GitoriousInternalApi) httpClient() *http.Client {
+	a.clientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: a.ConnectTimeout}
+		dial := dialer.DialContext
+		proxy := http.ProxyFromEnvironment
+
+		if strings.HasPrefix(a.ApiUrl, unixSocketScheme) {
+			socketPath := strings.TrimPrefix(a.ApiUrl, unixSocketScheme)
+			dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socketPath)
+			}
+			proxy = nil
+		}
+
+		a.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 proxy,
+				DialContext:           dial,
+				TLSHandshakeTimeout:   a.ConnectTimeout,
+				ResponseHeaderTimeout: a.ReadTimeout,
+			},
+		}
+
+		if a.ReadTimeout > 0 { // bound reading of the response body as well
+			a.client.Timeout = a.ConnectTimeout + a.ReadTimeout
+		}
+	})
+
+	return a.client
+}
+
 func (a *GitoriousInternalApi) getJson(u *url.URL, target interface{}) error {
-	request, err := http.NewRequest("GET", u.String(), nil)
+	backoff := a.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := a.tryRequest("GET", u, nil, target)
+
+		unavailableErr, ok := err.(*UnavailableError)
+		if !ok || unavailableErr.Err == ErrCircuitOpen || attempt >= a.MaxRetries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (a *GitoriousInternalApi) postForm(u *url.URL, form url.Values, target interface{}) error {
+	return a.tryRequest("POST", u, &requestBody{[]byte(form.Encode()), "application/x-www-form-urlencoded"}, target)
+}
+
+func (a *GitoriousInternalApi) postJson(u *url.URL, payload interface{}, target interface{}) error {
+	data, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
 
-	request.Header.Add("Accept", "application/json")
+	return a.tryRequest("POST", u, &requestBody{data, "application/json"}, target)
+}
+
+type requestBody struct {
+	data        []byte
+	contentType string
+}
+
+func (a *GitoriousInternalApi) tryRequest(method string, u *url.URL, body *requestBody, target interface{}) error {
+	if a.Breaker != nil && !a.Breaker.Allow() {
+		return &UnavailableError{ErrCircuitOpen}
+	}
+
+	err := a.doRequest(method, u, body, target)
+
+	if a.Breaker != nil {
+		if _, ok := err.(*UnavailableError); ok {
+			a.Breaker.Failure()
+		} else {
+			a.Breaker.Success()
+		}
+	}
+
+	return err
+}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+func (a *GitoriousInternalApi) doRequest(method string, u *url.URL, body *requestBody, target interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body.data)
+	}
+
+	request, err := http.NewRequest(method, u.String(), bodyReader)
 	if err != nil {
 		return err
 	}
+
+	request.Header.Add("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", body.contentType)
+	}
+
+	if a.SigningKey != nil {
+		var data []byte
+		if body != nil {
+			data = body.data
+		}
+
+		SignRequest(a.SigningKey, request, data)
+	}
+
+	// errors end up in logs, make sure they don't include credentials
+	errUrl := redactUrl(u)
+
+	response, err := a.httpClient().Do(request)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = errUrl.String()
+		}
+
+		return &UnavailableError{err}
+	}
 	defer response.Body.Close()
 
 	if response.StatusCode != 200 {
-		return &HttpError{u, response.StatusCode}
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorMessageLength))
+		httpErr := &HttpError{errUrl, response.StatusCode, string(message)}
+
+		switch response.StatusCode {
+		case 502, 503, 504:
+			return &UnavailableError{httpErr}
+		default:
+			return httpErr
+		}
+	}
+
+	if target == nil {
+		return nil
 	}
 
 	decoder := json.NewDecoder(response.Body)
@@ -115,3 +400,17 @@ func (a *GitoriousInternalApi) getJson(u *url.URL, target interface{}) error {
 
 	return nil
 }
+
+func redactUrl(u *url.URL) *url.URL {
+	q := u.Query()
+	if q.Get("password") == "" {
+		return u
+	}
+
+	q.Set("password", "FILTERED")
+
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+
+	return &redacted
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	*httptest.Server
+	requests []*http.Request
+	statuses []int
+}
+
+// newTestServer starts a server responding with the given statuses to
+// subsequent requests (the last one is repeated).
+func newTestServer(statuses ...int) *testServer {
+	s := &testServer{statuses: statuses}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := s.statuses[len(s.statuses)-1]
+		if len(s.requests) < len(s.statuses) {
+			status = s.statuses[len(s.requests)]
+		}
+
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Form, _ = url.ParseQuery(string(body))
+		s.requests = append(s.requests, req)
+
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"repository_id": 1, "full_path": "/repos/1.git", "access_level": "write", "username": "sickill", "scopes": ["read"]}`)
+	}))
+
+	return s
+}
+
+func newTestApi(apiUrl string) *GitoriousInternalApi {
+	a := NewGitoriousInternalApi(apiUrl)
+	a.RetryBackoff = time.Millisecond
+
+	return a
+}
+
+func TestGitoriousInternalApi_GetRepoConfig(t *testing.T) {
+	server := newTestServer(200)
+	defer server.Close()
+
+	repoConfig, err := newTestApi(server.URL).GetRepoConfig("foo/bar.git", "sickill")
+
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if repoConfig.RepositoryId != 1 || repoConfig.FullPath != "/repos/1.git" || repoConfig.AccessLevel != AccessWrite {
+		t.Errorf("unexpected repo config %+v", repoConfig)
+	}
+
+	expectedUri := "/repo-config?repo_path=foo%2Fbar.git&username=sickill"
+	if server.requests[0].RequestURI != expectedUri {
+		t.Errorf(`expected request to "%v", got "%v"`, expectedUri, server.requests[0].RequestURI)
+	}
+}
+
+func TestRepoConfig_WriteDenied(t *testing.T) {
+	var tests = []struct {
+		accessLevel    AccessLevel
+		expectedDenied bool
+	}{
+		{AccessUnknown, false},
+		{AccessRead, true},
+		{AccessWrite, false},
+		{AccessAdmin, false},
+		{AccessLevel("none"), true},
+	}
+
+	for _, test := range tests {
+		repoConfig := &RepoConfig{AccessLevel: test.accessLevel}
+
+		if repoConfig.WriteDenied() != test.expectedDenied {
+			t.Errorf("expected WriteDenied() to be %v for %q", test.expectedDenied, test.accessLevel)
+		}
+	}
+}
+
+func TestGitoriousInternalApi_Retries(t *testing.T) {
+	var tests = []struct {
+		statuses            []int
+		expectedRequests    int
+		expectedStatus      int
+		expectedUnavailable bool
+	}{
+		{[]int{503, 502, 200}, 3, 200, false},
+		{[]int{503}, 3, 503, true},
+		{[]int{504, 404}, 2, 404, false},
+		{[]int{500}, 1, 500, false},
+		{[]int{403}, 1, 403, false},
+	}
+
+	for _, test := range tests {
+		server := newTestServer(test.statuses...)
+
+		_, err := newTestApi(server.URL).GetRepoConfig("foo/bar.git", "sickill")
+		server.Close()
+
+		if len(server.requests) != test.expectedRequests {
+			t.Errorf("expected %v requests, got %v (%v)", test.expectedRequests, len(server.requests), test)
+		}
+
+		if test.expectedStatus == 200 {
+			if err != nil {
+				t.Errorf("expected no error, got %v (%v)", err, test)
+			}
+			continue
+		}
+
+		if unavailableErr, ok := err.(*UnavailableError); ok {
+			err = unavailableErr.Err
+			if !test.expectedUnavailable {
+				t.Errorf("didn't expect UnavailableError (%v)", test)
+			}
+		} else if test.expectedUnavailable {
+			t.Errorf("expected UnavailableError, got %v (%v)", err, test)
+		}
+
+		if httpErr, ok := err.(*HttpError); !ok || httpErr.StatusCode != test.expectedStatus {
+			t.Errorf("expected HttpError with status %v, got %v (%v)", test.expectedStatus, err, test)
+		}
+	}
+}
+
+func TestGitoriousInternalApi_CircuitBreaker(t *testing.T) {
+	server := newTestServer(503)
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+	a.MaxRetries = 0
+	a.Breaker = NewCircuitBreaker(2, time.Minute)
+
+	a.GetRepoConfig("foo/bar.git", "sickill")
+	a.GetRepoConfig("foo/bar.git", "sickill")
+	_, err := a.GetRepoConfig("foo/bar.git", "sickill")
+
+	if len(server.requests) != 2 {
+		t.Errorf("expected 2 requests before circuit opens, got %v", len(server.requests))
+	}
+
+	if unavailableErr, ok := err.(*UnavailableError); !ok || unavailableErr.Err != ErrCircuitOpen {
+		t.Errorf("expected UnavailableError with ErrCircuitOpen, got %v", err)
+	}
+}
+
+func TestGitoriousInternalApi_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+	a.ReadTimeout = 50 * time.Millisecond
+	a.MaxRetries = 0
+
+	_, err := a.GetRepoConfig("foo/bar.git", "sickill")
+
+	if _, ok := err.(*UnavailableError); !ok {
+		t.Errorf("expected UnavailableError, got %v", err)
+	}
+}
+
+func TestGitoriousInternalApi_AuthenticateUser(t *testing.T) {
+	server := newTestServer(200, 401)
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	user, err := a.AuthenticateUser("sickill", "secret")
+	if err != nil || user == nil || user.Username != "sickill" {
+		t.Errorf("expected user sickill, got %v (error: %v)", user, err)
+	}
+
+	request := server.requests[0]
+	if request.Method != "POST" || request.RequestURI != "/authenticate" {
+		t.Errorf(`expected "POST /authenticate", got "%v %v"`, request.Method, request.RequestURI)
+	}
+	if request.Form.Get("username") != "sickill" || request.Form.Get("password") != "secret" {
+		t.Errorf("expected credentials in request body, got %v", request.Form)
+	}
+
+	user, err = a.AuthenticateUser("sickill", "wrong")
+	if err != nil || user != nil {
+		t.Errorf("expected no user and no error for invalid credentials, got %v (error: %v)", user, err)
+	}
+}
+
+func TestGitoriousInternalApi_AuthenticateUser_Legacy(t *testing.T) {
+	server := newTestServer(200, 500)
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+	a.LegacyAuthentication = true
+
+	user, err := a.AuthenticateUser("sickill", "secret")
+	if err != nil || user == nil || user.Username != "sickill" {
+		t.Errorf("expected user sickill, got %v (error: %v)", user, err)
+	}
+
+	request := server.requests[0]
+	if request.Method != "GET" || request.URL.Query().Get("password") != "secret" {
+		t.Errorf("expected credentials in query string of GET request, got %v %v", request.Method, request.RequestURI)
+	}
+
+	_, err = a.AuthenticateUser("sickill", "secret")
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected error without password, got %v", err)
+	}
+
+	server.Close()
+
+	_, err = a.AuthenticateUser("sickill", "secret")
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected error without password, got %v", err)
+	}
+}
+
+func TestGitoriousInternalApi_AuthenticateToken(t *testing.T) {
+	server := newTestServer(200, 401)
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	token, err := a.AuthenticateToken("abc123")
+	if err != nil || token == nil || token.Username != "sickill" || !token.HasScope(ScopeRead) {
+		t.Errorf("expected read token of sickill, got %v (error: %v)", token, err)
+	}
+
+	request := server.requests[0]
+	if request.Method != "POST" || request.RequestURI != "/authenticate-token" {
+		t.Errorf(`expected "POST /authenticate-token", got "%v %v"`, request.Method, request.RequestURI)
+	}
+	if request.Form.Get("token") != "abc123" {
+		t.Errorf("expected token in request body, got %v", request.Form)
+	}
+
+	token, err = a.AuthenticateToken("revoked")
+	if err != nil || token != nil {
+		t.Errorf("expected no token and no error for invalid token, got %v (error: %v)", token, err)
+	}
+}
+
+func TestGitoriousInternalApi_AuthenticateToken_NotSupported(t *testing.T) {
+	server := newTestServer(404, 500)
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	token, err := a.AuthenticateToken("abc123")
+	if err != nil || token != nil {
+		t.Errorf("expected no token and no error when tokens are not supported, got %v (error: %v)", token, err)
+	}
+
+	if _, err := a.AuthenticateToken("abc123"); err == nil {
+		t.Errorf("expected error for status 500")
+	}
+}
+
+func TestAccessToken_Allows(t *testing.T) {
+	var tests = []struct {
+		scopes   []TokenScope
+		isPush   bool
+		expected bool
+	}{
+		{[]TokenScope{ScopeRead}, false, true},
+		{[]TokenScope{ScopeRead}, true, false},
+		{[]TokenScope{ScopeWrite}, false, true},
+		{[]TokenScope{ScopeWrite}, true, true},
+		{[]TokenScope{ScopeRead, ScopeWrite}, true, true},
+		{[]TokenScope{"api"}, false, false},
+		{nil, false, false},
+	}
+
+	for _, test := range tests {
+		token := &AccessToken{Username: "sickill", Scopes: test.scopes}
+
+		if allows := token.Allows(test.isPush); allows != test.expected {
+			t.Errorf("expected %v, got %v (%v)", test.expected, allows, test)
+		}
+	}
+}
+
+func TestGitoriousInternalApi_UnixSocket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gitorious-proto")
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requestUri string
+	key := []byte("s3cr3t")
+	verifier := &Verifier{Key: key}
+
+	server := httptest.NewUnstartedServer(verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestUri = req.RequestURI
+		fmt.Fprintf(w, `{"repository_id": 1, "full_path": "/repos/1.git"}`)
+	})))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	a := newTestApi("unix://" + socketPath)
+	a.SigningKey = key
+
+	repoConfig, err := a.GetRepoConfig("foo/bar.git", "sickill")
+	if err != nil || repoConfig.FullPath != "/repos/1.git" {
+		t.Errorf("expected repo config, got %v (error: %v)", repoConfig, err)
+	}
+
+	expectedUri := "/api/internal/repo-config?repo_path=foo%2Fbar.git&username=sickill"
+	if requestUri != expectedUri {
+		t.Errorf(`expected request to "%v", got "%v"`, expectedUri, requestUri)
+	}
+}
@@ -0,0 +1,38 @@
+package api
+
+type SshKey struct {
+	Username string `json:"username"`
+	Key      string `json:"key"` // "<type> <base64 encoded key>", as in authorized_keys
+}
+
+// KeysApi is the part of the internal API used for looking up SSH keys by
+// sshd's AuthorizedKeysCommand.
+type KeysApi interface {
+	FindSshKey(fingerprint string) (*SshKey, error)
+}
+
+// FindSshKey returns the key with the given fingerprint (as printed by
+// ssh-keygen -l), along with its owner. It returns nil key when there's no
+// such key.
+func (a *GitoriousInternalApi) FindSshKey(fingerprint string) (*SshKey, error) {
+	u, err := a.endpoint("/ssh-key")
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("fingerprint", fingerprint)
+	u.RawQuery = q.Encode()
+
+	var key SshKey
+
+	if err := a.getJson(u, &key); err != nil {
+		if httpErr, ok := err.(*HttpError); ok && httpErr.StatusCode == 404 {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &key, nil
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitoriousInternalApi_FindSshKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ssh-key" || req.URL.Query().Get("fingerprint") != "SHA256:known" {
+			w.WriteHeader(404)
+			return
+		}
+
+		fmt.Fprintf(w, `{"username": "sickill", "key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDl3"}`)
+	}))
+	defer server.Close()
+
+	a := newTestApi(server.URL)
+
+	key, err := a.FindSshKey("SHA256:known")
+	if err != nil || key == nil || key.Username != "sickill" || key.Key != "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDl3" {
+		t.Errorf("unexpected key %+v (error: %v)", key, err)
+	}
+
+	key, err = a.FindSshKey("SHA256:unknown")
+	if err != nil || key != nil {
+		t.Errorf("expected no key and no error for unknown fingerprint, got %+v (error: %v)", key, err)
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Gitorious-Timestamp"
+	SignatureHeader = "X-Gitorious-Signature"
+
+	DefaultMaxClockSkew = 5 * time.Minute
+	DefaultMaxBodySize  = 16 << 20
+)
+
+// LoadSigningKey reads the key used for signing internal API requests from
+// the given file, falling back to GITORIOUS_INTERNAL_API_SECRET environment
+// variable when no file is given. It returns nil key when neither is set.
+func LoadSigningKey(path string) ([]byte, error) {
+	if path == "" {
+		if secret := os.Getenv("GITORIOUS_INTERNAL_API_SECRET"); secret != "" {
+			return []byte(secret), nil
+		}
+
+		return nil, nil
+	}
+
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := []byte(strings.TrimSpace(string(secret)))
+	if len(key) == 0 {
+		return nil, errors.New(fmt.Sprintf(`signing key file "%v" is empty`, path))
+	}
+
+	return key, nil
+}
+
+// BodyHash returns hex encoded SHA-256 of request body (empty for requests
+// without body).
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Signature returns hex encoded HMAC-SHA256 of request method, path, query,
+// body hash (see BodyHash) and timestamp, separated with new lines.
+func Signature(key []byte, method, path, query, bodyHash, timestamp string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v\n%v", method, path, query, bodyHash, timestamp)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest signs req, which has the given body.
+func SignRequest(key []byte, req *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := Signature(key, req.Method, req.URL.EscapedPath(), req.URL.RawQuery, BodyHash(body), timestamp)
+
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, signature)
+}
+
+// Verifier checks signatures of requests signed with SignRequest (or by
+// hooks). It's meant for servers implementing the internal API.
+type Verifier struct {
+	Key          []byte
+	MaxClockSkew time.Duration // defaults to DefaultMaxClockSkew
+	MaxBodySize  int64         // defaults to DefaultMaxBodySize
+
+	now func() time.Time
+}
+
+// Verify checks the signature of req. The body is read in order to check its
+// hash, and replaced with a copy, so it can still be read by handlers.
+func (v *Verifier) Verify(req *http.Request) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	signature := req.Header.Get(SignatureHeader)
+
+	if timestamp == "" || signature == "" {
+		return errors.New("request is not signed")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf(`invalid timestamp "%v"`, timestamp))
+	}
+
+	maxClockSkew := v.MaxClockSkew
+	if maxClockSkew == 0 {
+		maxClockSkew = DefaultMaxClockSkew
+	}
+
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+
+	skew := now().Sub(time.Unix(seconds, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return errors.New(fmt.Sprintf("timestamp %v is off by %v", timestamp, skew))
+	}
+
+	body, err := v.readBody(req)
+	if err != nil {
+		return err
+	}
+
+	expected := Signature(v.Key, req.Method, req.URL.EscapedPath(), req.URL.RawQuery, BodyHash(body), timestamp)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+func (v *Verifier) readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	maxBodySize := v.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > maxBodySize {
+		return nil, errors.New(fmt.Sprintf("request body is larger than %v bytes", maxBodySize))
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// Handler wraps h, responding with 400 to requests with invalid signatures
+// (401 and 403 mean invalid user credentials and denied access respectively).
+func (v *Verifier) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := v.Verify(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	key := []byte("s3cr3t")
+	clock := &fakeClock{time.Now()}
+	verifier := &Verifier{Key: key, now: clock.now}
+
+	req, _ := http.NewRequest("GET", "http://localhost/api/internal/repo-config?repo_path=foo%2Fbar.git&username=sickill", nil)
+	SignRequest(key, req, nil)
+
+	if err := verifier.Verify(req); err != nil {
+		t.Errorf("expected valid signature, got %v", err)
+	}
+
+	tampered := *req
+	tampered.URL, _ = req.URL.Parse("/api/internal/repo-config?repo_path=foo%2Fbar.git&username=admin")
+	if err := verifier.Verify(&tampered); err == nil {
+		t.Errorf("expected error for tampered query")
+	}
+
+	tampered = *req
+	tampered.Method = "POST"
+	if err := verifier.Verify(&tampered); err == nil {
+		t.Errorf("expected error for tampered method")
+	}
+
+	if err := (&Verifier{Key: []byte("other"), now: clock.now}).Verify(req); err == nil {
+		t.Errorf("expected error for different key")
+	}
+
+	clock.t = clock.t.Add(DefaultMaxClockSkew + time.Second)
+	if err := verifier.Verify(req); err == nil {
+		t.Errorf("expected error for expired timestamp")
+	}
+
+	unsigned, _ := http.NewRequest("GET", "http://localhost/api/internal/repo-config", nil)
+	if err := verifier.Verify(unsigned); err == nil {
+		t.Errorf("expected error for unsigned request")
+	}
+}
+
+func TestVerifier_Verify_Body(t *testing.T) {
+	key := []byte("s3cr3t")
+	verifier := &Verifier{Key: key, MaxBodySize: 32}
+
+	var tests = []struct {
+		signedBody    string
+		sentBody      string
+		expectedError bool
+	}{
+		{"username=sickill&password=secret", "username=sickill&password=secret", false},
+		{"username=sickill&password=secret", "username=admin&password=secret", true},
+		{"", "username=admin", true},
+		{"username=sickill&password=secret!", "username=sickill&password=secret!", true}, // too large
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://localhost/api/internal/authenticate", bytes.NewReader([]byte(test.sentBody)))
+		SignRequest(key, req, []byte(test.signedBody))
+
+		err := verifier.Verify(req)
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("expected error: %v, got %v (%v)", test.expectedError, err, test)
+			continue
+		}
+
+		if err == nil {
+			if body, _ := ioutil.ReadAll(req.Body); string(body) != test.sentBody {
+				t.Errorf("expected body %q to be readable after verification, got %q", test.sentBody, body)
+			}
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	var tests = []struct {
+		method   string
+		path     string
+		query    string
+		body     string
+		expected string
+	}{
+		// the same as `printf 'GET\n/api/internal/hooks/pre-receive\nusername=sickill\n%s\n1400000000' $(printf '' | sha256sum | cut -d' ' -f1) | openssl dgst -sha256 -hmac s3cr3t`
+		{"GET", "/api/internal/hooks/pre-receive", "username=sickill", "", "9dc6bd82970ca7d0558693ffb44395a57a36d67099d8c726e9686923348ab35e"},
+		{"POST", "/api/internal/authenticate", "", "username=sickill", "7b55c9d9e8e79375b33a2c14fc398a278a45953054ccb3e360741b8db6c35786"},
+	}
+
+	for _, test := range tests {
+		actual := Signature([]byte("s3cr3t"), test.method, test.path, test.query, BodyHash([]byte(test.body)), "1400000000")
+
+		if actual != test.expected {
+			t.Errorf(`expected signature "%v", got "%v" (%v)`, test.expected, actual, test)
+		}
+	}
+}
+
+func TestGitoriousInternalApi_SigningKey(t *testing.T) {
+	key := []byte("s3cr3t")
+	verifier := &Verifier{Key: key}
+
+	server := httptest.NewServer(verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"repository_id": 1, "username": "sickill"}`)
+	})))
+	defer server.Close()
+
+	a := newTestApi(server.URL + "/api/internal")
+
+	if _, err := a.GetRepoConfig("foo/bar.git", "sickill"); err == nil {
+		t.Errorf("expected error for unsigned request")
+	}
+
+	a.SigningKey = key
+
+	if _, err := a.GetRepoConfig("foo/bar.git", "sickill"); err != nil {
+		t.Errorf("expected no error for signed GET request, got %v", err)
+	}
+
+	if _, err := a.AuthenticateUser("sickill", "secret"); err != nil {
+		t.Errorf("expected no error for signed POST request, got %v", err)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gitorious-proto")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secret")
+	ioutil.WriteFile(path, []byte("from-file\n"), 0600)
+	os.Setenv("GITORIOUS_INTERNAL_API_SECRET", "from-env")
+	defer os.Unsetenv("GITORIOUS_INTERNAL_API_SECRET")
+
+	if key, err := LoadSigningKey(path); err != nil || string(key) != "from-file" {
+		t.Errorf(`expected key "from-file", got "%s" (error: %v)`, key, err)
+	}
+
+	if key, err := LoadSigningKey(""); err != nil || string(key) != "from-env" {
+		t.Errorf(`expected key "from-env", got "%s" (error: %v)`, key, err)
+	}
+
+	if _, err := LoadSigningKey(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+
+	os.Unsetenv("GITORIOUS_INTERNAL_API_SECRET")
+
+	if key, err := LoadSigningKey(""); err != nil || key != nil {
+		t.Errorf(`expected no key, got "%s" (error: %v)`, key, err)
+	}
+}
@@ -0,0 +1,29 @@
+package common
+
+import "io"
+
+// CountingReader counts bytes read through it.
+type CountingReader struct {
+	Reader io.Reader
+	Count  int64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Count += int64(n)
+
+	return n, err
+}
+
+// CountingWriter counts bytes written through it.
+type CountingWriter struct {
+	Writer io.Writer
+	Count  int64
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.Count += int64(n)
+
+	return n, err
+}
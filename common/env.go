@@ -3,12 +3,24 @@ package common
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"gitorious.org/gitorious/gitorious-proto/api"
 )
 
 func CreateEnv(protocol, username string, repoConfig *api.RepoConfig) []string {
-	env := os.Environ()
+	var env []string
+
+	for _, envVar := range os.Environ() {
+		// protocol version is what the client asks for (see AppendGitProtocol),
+		// not what the server process happens to have set
+		if !strings.HasPrefix(envVar, "GIT_PROTOCOL=") {
+			env = append(env, envVar)
+		}
+	}
 
 	// used by hooks
 	env = append(env, "GITORIOUS_PROTO="+protocol)
@@ -42,6 +54,40 @@ func CreateEnv(protocol, username string, repoConfig *api.RepoConfig) []string {
 	return env
 }
 
+// colon separated "key=value" parameters, like "version=2"
+var gitProtocolRegexp = regexp.MustCompile("^[a-zA-Z0-9._=:-]+$")
+
+// AppendGitProtocol passes protocol parameters requested by the client (in
+// GIT_PROTOCOL environment variable over SSH or Git-Protocol header over HTTP)
+// to git. Malformed values are ignored, making git fall back to protocol v0.
+func AppendGitProtocol(env []string, gitProtocol string) []string {
+	if !gitProtocolRegexp.MatchString(gitProtocol) {
+		return env
+	}
+
+	return append(env, "GIT_PROTOCOL="+gitProtocol)
+}
+
+// GitProtocolVersion returns the highest protocol version requested in
+// gitProtocol, the same way git does.
+func GitProtocolVersion(gitProtocol string) int {
+	if !gitProtocolRegexp.MatchString(gitProtocol) {
+		return 0
+	}
+
+	version := 0
+
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if strings.HasPrefix(param, "version=") {
+			if v, err := strconv.Atoi(strings.TrimPrefix(param, "version=")); err == nil && v > version {
+				version = v
+			}
+		}
+	}
+
+	return version
+}
+
 func Getenv(name, defaultValue string) string {
 	value := os.Getenv(name)
 
@@ -51,3 +97,47 @@ func Getenv(name, defaultValue string) string {
 
 	return value
 }
+
+func GetenvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+
+	return value
+}
+
+func GetenvFloat(name string, defaultValue float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return defaultValue
+	}
+
+	return value
+}
+
+func GetenvDuration(name string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+
+	return value
+}
+
+// NewInternalApiFromEnv creates internal API client configured with
+// GITORIOUS_INTERNAL_API_* environment variables.
+func NewInternalApiFromEnv() (*api.GitoriousInternalApi, error) {
+	internalApi := api.NewGitoriousInternalApi(Getenv("GITORIOUS_INTERNAL_API_URL", "http://localhost:3000/api/internal"))
+	internalApi.ConnectTimeout = GetenvDuration("GITORIOUS_INTERNAL_API_CONNECT_TIMEOUT", api.DefaultConnectTimeout)
+	internalApi.ReadTimeout = GetenvDuration("GITORIOUS_INTERNAL_API_READ_TIMEOUT", api.DefaultReadTimeout)
+	internalApi.MaxRetries = GetenvInt("GITORIOUS_INTERNAL_API_RETRIES", api.DefaultMaxRetries)
+
+	signingKey, err := api.LoadSigningKey(os.Getenv("GITORIOUS_INTERNAL_API_SECRET_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	internalApi.SigningKey = signingKey
+
+	return internalApi, nil
+}
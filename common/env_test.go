@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"gitorious.org/gitorious/gitorious-proto/api"
 )
@@ -71,3 +72,107 @@ func TestCreateEnv(t *testing.T) {
 	assertPresence(env, "GITORIOUS_CUSTOM_POST_RECEIVE_PATH=custom-post-receive", t)
 	assertPresence(env, "GITORIOUS_CUSTOM_UPDATE_PATH=custom-update", t)
 }
+
+func TestGetenvInt(t *testing.T) {
+	os.Setenv("GITORIOUS_TEST_INT", "3")
+	if value := GetenvInt("GITORIOUS_TEST_INT", 1); value != 3 {
+		t.Errorf("expected 3, got %v", value)
+	}
+
+	os.Setenv("GITORIOUS_TEST_INT", "three")
+	if value := GetenvInt("GITORIOUS_TEST_INT", 1); value != 1 {
+		t.Errorf("expected default value 1 for invalid number, got %v", value)
+	}
+
+	os.Unsetenv("GITORIOUS_TEST_INT")
+	if value := GetenvInt("GITORIOUS_TEST_INT", 1); value != 1 {
+		t.Errorf("expected default value 1 for missing variable, got %v", value)
+	}
+}
+
+func TestGetenvFloat(t *testing.T) {
+	os.Setenv("GITORIOUS_TEST_FLOAT", "0.5")
+	if value := GetenvFloat("GITORIOUS_TEST_FLOAT", 1); value != 0.5 {
+		t.Errorf("expected 0.5, got %v", value)
+	}
+
+	os.Setenv("GITORIOUS_TEST_FLOAT", "half")
+	if value := GetenvFloat("GITORIOUS_TEST_FLOAT", 1); value != 1 {
+		t.Errorf("expected default value 1 for invalid number, got %v", value)
+	}
+
+	os.Unsetenv("GITORIOUS_TEST_FLOAT")
+	if value := GetenvFloat("GITORIOUS_TEST_FLOAT", 1); value != 1 {
+		t.Errorf("expected default value 1 for missing variable, got %v", value)
+	}
+}
+
+func TestGetenvDuration(t *testing.T) {
+	os.Setenv("GITORIOUS_TEST_DURATION", "1m30s")
+	if value := GetenvDuration("GITORIOUS_TEST_DURATION", time.Second); value != 90*time.Second {
+		t.Errorf("expected 1m30s, got %v", value)
+	}
+
+	os.Setenv("GITORIOUS_TEST_DURATION", "90")
+	if value := GetenvDuration("GITORIOUS_TEST_DURATION", time.Second); value != time.Second {
+		t.Errorf("expected default value 1s for invalid duration, got %v", value)
+	}
+
+	os.Unsetenv("GITORIOUS_TEST_DURATION")
+	if value := GetenvDuration("GITORIOUS_TEST_DURATION", time.Second); value != time.Second {
+		t.Errorf("expected default value 1s for missing variable, got %v", value)
+	}
+}
+
+func TestCreateEnv_GitProtocol(t *testing.T) {
+	os.Setenv("GIT_PROTOCOL", "version=2")
+	defer os.Unsetenv("GIT_PROTOCOL")
+
+	env := CreateEnv("ssh", "sickill", &api.RepoConfig{RepositoryId: 123})
+
+	assertAbsence(env, "GIT_PROTOCOL", t)
+}
+
+func TestAppendGitProtocol(t *testing.T) {
+	var tests = []struct {
+		gitProtocol string
+		expected    string
+	}{
+		{"version=2", "GIT_PROTOCOL=version=2"},
+		{"version=2:object-format=sha256", "GIT_PROTOCOL=version=2:object-format=sha256"},
+		{"", ""},
+		{"version=2\nGIT_DIR=/etc", ""},
+		{"version=2 foo", ""},
+	}
+
+	for _, test := range tests {
+		env := AppendGitProtocol([]string{"HOME=/home/git"}, test.gitProtocol)
+
+		if test.expected == "" {
+			assertAbsence(env, "GIT_PROTOCOL", t)
+		} else {
+			assertPresence(env, test.expected, t)
+		}
+	}
+}
+
+func TestGitProtocolVersion(t *testing.T) {
+	var tests = []struct {
+		gitProtocol string
+		expected    int
+	}{
+		{"", 0},
+		{"version=1", 1},
+		{"version=2", 2},
+		{"object-format=sha256:version=2", 2},
+		{"version=2:version=1", 2},
+		{"version=x", 0},
+		{"version=2 foo", 0},
+	}
+
+	for _, test := range tests {
+		if actual := GitProtocolVersion(test.gitProtocol); actual != test.expected {
+			t.Errorf("expected version %v, got %v (%v)", test.expected, actual, test)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LfsTokenScheme is the Authorization header scheme of LFS tokens, as in
+// "Authorization: RemoteAuth <token>".
+const LfsTokenScheme = "RemoteAuth"
+
+// LfsToken grants short-lived access to Git LFS endpoints of
+// gitorious-http-backend. It's issued by gitorious-shell for
+// git-lfs-authenticate command, so users with SSH remotes don't need HTTP
+// credentials.
+type LfsToken struct {
+	Username  string `json:"username"`
+	RepoPath  string `json:"repo_path"`
+	Operation string `json:"operation"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// lfsTokenKey derives the key for signing tokens from the internal API key, so
+// tokens can never be used as request signatures and vice versa.
+func lfsTokenKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gitorious-lfs-token"))
+
+	return mac.Sum(nil)
+}
+
+func signLfsTokenPayload(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, lfsTokenKey(key))
+	mac.Write([]byte(payload))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the token in "<base64 encoded JSON>.<hex encoded HMAC-SHA256>"
+// format.
+func (t *LfsToken) Sign(key []byte) (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + signLfsTokenPayload(key, payload), nil
+}
+
+// Allows tells whether the token can be used for the given LFS operation on the
+// given repository. Upload tokens allow downloads as well.
+func (t *LfsToken) Allows(repoPath, operation string) bool {
+	if strings.TrimPrefix(t.RepoPath, "/") != strings.TrimPrefix(repoPath, "/") {
+		return false
+	}
+
+	return t.Operation == operation || t.Operation == "upload"
+}
+
+func VerifyLfsToken(key []byte, token string, now time.Time) (*LfsToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed LFS token")
+	}
+
+	expected := signLfsTokenPayload(key, parts[0])
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return nil, errors.New("invalid LFS token signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var t LfsToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+
+	if now.Unix() >= t.ExpiresAt {
+		return nil, errors.New(fmt.Sprintf("LFS token expired at %v", time.Unix(t.ExpiresAt, 0)))
+	}
+
+	return &t, nil
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyLfsToken(t *testing.T) {
+	key := []byte("s3cr3t")
+	now := time.Unix(1400000000, 0)
+
+	token, err := (&LfsToken{"sickill", "foo/bar.git", "upload", now.Add(time.Minute).Unix()}).Sign(key)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	lfsToken, err := VerifyLfsToken(key, token, now)
+	if err != nil {
+		t.Fatalf("expected valid token, got %v", err)
+	}
+
+	if lfsToken.Username != "sickill" || lfsToken.RepoPath != "foo/bar.git" || lfsToken.Operation != "upload" {
+		t.Errorf("unexpected token %+v", lfsToken)
+	}
+
+	if _, err := VerifyLfsToken(key, token, now.Add(time.Minute)); err == nil {
+		t.Errorf("expected error for expired token")
+	}
+
+	if _, err := VerifyLfsToken([]byte("other"), token, now); err == nil {
+		t.Errorf("expected error for token signed with different key")
+	}
+
+	forged, _ := (&LfsToken{"admin", "foo/bar.git", "upload", now.Add(time.Minute).Unix()}).Sign([]byte("other"))
+	if _, err := VerifyLfsToken(key, forged[:len(forged)-64]+token[len(token)-64:], now); err == nil {
+		t.Errorf("expected error for tampered payload")
+	}
+
+	if _, err := VerifyLfsToken(key, "garbage", now); err == nil {
+		t.Errorf("expected error for malformed token")
+	}
+}
+
+func TestLfsToken_Allows(t *testing.T) {
+	var tests = []struct {
+		tokenOperation string
+		repoPath       string
+		operation      string
+		expected       bool
+	}{
+		{"download", "foo/bar.git", "download", true},
+		{"download", "/foo/bar.git", "download", true},
+		{"download", "foo/bar.git", "upload", false},
+		{"upload", "foo/bar.git", "upload", true},
+		{"upload", "foo/bar.git", "download", true},
+		{"upload", "foo/baz.git", "download", false},
+	}
+
+	for _, test := range tests {
+		token := &LfsToken{"sickill", "foo/bar.git", test.tokenOperation, 0}
+
+		if actual := token.Allows(test.repoPath, test.operation); actual != test.expected {
+			t.Errorf("expected %v, got %v (%v)", test.expected, actual, test)
+		}
+	}
+}
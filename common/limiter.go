@@ -0,0 +1,532 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Limits configures Limiter. Zero values mean no limit.
+type Limits struct {
+	MaxPerUser int // concurrent operations of an authenticated user
+	MaxPerIp   int // concurrent operations from a client IP
+	MaxPerRepo int // concurrent operations on a repository
+
+	// token bucket refilled with Rate tokens per second up to Burst tokens,
+	// kept for each user and each IP
+	Rate  float64
+	Burst int
+}
+
+func (l Limits) Enabled() bool {
+	return l.MaxPerUser > 0 || l.MaxPerIp > 0 || l.MaxPerRepo > 0 || l.Rate > 0
+}
+
+func (l Limits) max(scope string) int {
+	switch scope {
+	case "user":
+		return l.MaxPerUser
+	case "ip":
+		return l.MaxPerIp
+	case "repo":
+		return l.MaxPerRepo
+	}
+
+	return 0
+}
+
+func (l Limits) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+
+	return l.Burst
+}
+
+// LimitKey identifies an operation. Empty User (anonymous access) is not
+// limited per user.
+type LimitKey struct {
+	User string
+	Ip   string
+	Repo string
+}
+
+type limitScope struct {
+	name  string
+	value string
+}
+
+func (k LimitKey) scopes() []limitScope {
+	var scopes []limitScope
+
+	for _, scope := range []limitScope{{"user", k.User}, {"ip", k.Ip}, {"repo", k.Repo}} {
+		if scope.value != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes
+}
+
+type LimitError struct {
+	Scope       string // "user", "ip" or "repo"
+	Value       string
+	RateLimited bool // request rate exceeded rather than concurrency
+}
+
+func (e *LimitError) Error() string {
+	if e.RateLimited {
+		return fmt.Sprintf("request rate limit for %v %v exceeded", e.Scope, e.Value)
+	}
+
+	return fmt.Sprintf("too many concurrent operations for %v %v", e.Scope, e.Value)
+}
+
+// Limiter limits concurrency and rate of git operations.
+type Limiter interface {
+	// Acquire returns a function to call when the operation is finished, or
+	// *LimitError when it must be rejected.
+	Acquire(key LimitKey) (release func(), err error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(rate float64, burst int, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+	}
+
+	b.last = now
+}
+
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	b.refill(rate, burst, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// buckets of clients not seen for a while are dropped when there are more
+// than this
+const maxTokenBuckets = 10000
+
+// MemoryLimiter keeps its state in memory, for use in a single long-running
+// process.
+type MemoryLimiter struct {
+	Limits Limits
+
+	mutex   sync.Mutex
+	active  map[limitScope]int
+	buckets map[limitScope]*tokenBucket
+	now     func() time.Time
+}
+
+func NewMemoryLimiter(limits Limits) *MemoryLimiter {
+	return &MemoryLimiter{
+		Limits:  limits,
+		active:  make(map[limitScope]int),
+		buckets: make(map[limitScope]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Acquire checks all the limits before taking anything, so rejected
+// operations don't use up tokens of the rate limits.
+func (l *MemoryLimiter) Acquire(key LimitKey) (func(), error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	scopes := key.scopes()
+
+	for _, scope := range scopes {
+		if max := l.Limits.max(scope.name); max > 0 && l.active[scope] >= max {
+			return nil, &LimitError{Scope: scope.name, Value: scope.value}
+		}
+	}
+
+	if l.Limits.Rate > 0 {
+		now := l.now()
+		var buckets []*tokenBucket
+
+		for _, scope := range scopes {
+			if scope.name == "repo" {
+				continue
+			}
+
+			bucket, ok := l.buckets[scope]
+			if !ok {
+				l.pruneBuckets(now)
+				bucket = &tokenBucket{}
+				l.buckets[scope] = bucket
+			}
+
+			bucket.refill(l.Limits.Rate, l.Limits.burst(), now)
+			if bucket.tokens < 1 {
+				return nil, &LimitError{Scope: scope.name, Value: scope.value, RateLimited: true}
+			}
+
+			buckets = append(buckets, bucket)
+		}
+
+		for _, bucket := range buckets {
+			bucket.tokens--
+		}
+	}
+
+	for _, scope := range scopes {
+		if l.Limits.max(scope.name) > 0 {
+			l.active[scope]++
+		}
+	}
+
+	var once sync.Once
+
+	release := func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+
+			for _, scope := range scopes {
+				if l.Limits.max(scope.name) > 0 {
+					if l.active[scope]--; l.active[scope] <= 0 {
+						delete(l.active, scope)
+					}
+				}
+			}
+		})
+	}
+
+	return release, nil
+}
+
+// pruneBuckets drops buckets which have refilled, as they're no different
+// from new ones.
+func (l *MemoryLimiter) pruneBuckets(now time.Time) {
+	if len(l.buckets) < maxTokenBuckets {
+		return
+	}
+
+	for scope, bucket := range l.buckets {
+		bucket.refill(l.Limits.Rate, l.Limits.burst(), now)
+
+		if bucket.tokens >= float64(l.Limits.burst()) {
+			delete(l.buckets, scope)
+		}
+	}
+}
+
+// FileLimiter shares its state between processes through files in Dir.
+// Concurrent operations hold flock()-ed slot files, which the kernel unlocks
+// even when the process holding them dies. Files of clients not seen for a
+// while are removed from time to time (see prune).
+type FileLimiter struct {
+	Limits Limits
+	Dir    string
+
+	now func() time.Time
+}
+
+func NewFileLimiter(limits Limits, dir string) (*FileLimiter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileLimiter{Limits: limits, Dir: dir, now: time.Now}, nil
+}
+
+func (l *FileLimiter) path(scope limitScope, suffix string) string {
+	sum := sha256.Sum256([]byte(scope.value))
+	return filepath.Join(l.Dir, fmt.Sprintf("%v-%x%v", scope.name, sum[:16], suffix))
+}
+
+// Acquire takes concurrency slots first and tokens of the rate limits then,
+// giving back what it took when the operation is rejected.
+func (l *FileLimiter) Acquire(key LimitKey) (func(), error) {
+	l.prune()
+
+	scopes := key.scopes()
+
+	var slots []*os.File
+
+	release := func() {
+		for _, slot := range slots {
+			slot.Close() // releases the lock
+		}
+		slots = nil
+	}
+
+	for _, scope := range scopes {
+		max := l.Limits.max(scope.name)
+		if max == 0 {
+			continue
+		}
+
+		slot, err := l.takeSlot(scope, max)
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		if slot == nil {
+			release()
+			return nil, &LimitError{Scope: scope.name, Value: scope.value}
+		}
+
+		slots = append(slots, slot)
+	}
+
+	if l.Limits.Rate > 0 {
+		var taken []limitScope
+
+		refund := func() {
+			for _, scope := range taken {
+				l.updateBucket(scope, os.O_RDWR, l.refundToken)
+			}
+		}
+
+		for _, scope := range scopes {
+			if scope.name == "repo" {
+				continue
+			}
+
+			ok, err := l.updateBucket(scope, os.O_RDWR|os.O_CREATE, l.takeToken)
+			if err != nil {
+				refund()
+				release()
+				return nil, err
+			}
+
+			if !ok {
+				refund()
+				release()
+				return nil, &LimitError{Scope: scope.name, Value: scope.value, RateLimited: true}
+			}
+
+			taken = append(taken, scope)
+		}
+	}
+
+	return release, nil
+}
+
+// lockFile opens and flock()s the file at path, making sure it wasn't removed
+// by prune in the meantime, as the lock would guard nothing then. It returns
+// nil when nonBlocking is set and the file is locked by someone else.
+func lockFile(path string, flag int, nonBlocking bool) (*os.File, error) {
+	how := syscall.LOCK_EX
+	if nonBlocking {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		file, err := os.OpenFile(path, flag, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := syscall.Flock(int(file.Fd()), how); err != nil {
+			file.Close()
+
+			if nonBlocking && err == syscall.EWOULDBLOCK {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		fileInfo, err1 := file.Stat()
+		pathInfo, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(fileInfo, pathInfo) {
+			return file, nil
+		}
+
+		file.Close()
+
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+	}
+}
+
+// takeSlot locks the first free of max slot files, returning nil when all of
+// them are taken.
+func (l *FileLimiter) takeSlot(scope limitScope, max int) (*os.File, error) {
+	for i := 0; i < max; i++ {
+		path := l.path(scope, fmt.Sprintf(".%v.slot", i))
+
+		file, err := lockFile(path, os.O_RDONLY|os.O_CREATE, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if file != nil {
+			// slot files not used for a while are pruned
+			now := l.now()
+			os.Chtimes(path, now, now)
+
+			return file, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (l *FileLimiter) takeToken(bucket *tokenBucket) bool {
+	return bucket.take(l.Limits.Rate, l.Limits.burst(), l.now())
+}
+
+func (l *FileLimiter) refundToken(bucket *tokenBucket) bool {
+	bucket.refill(l.Limits.Rate, l.Limits.burst(), l.now())
+	bucket.tokens = math.Min(float64(l.Limits.burst()), bucket.tokens+1)
+
+	return true
+}
+
+// updateBucket applies update to the bucket stored as "<tokens> <unix
+// nanos>", returning its result.
+func (l *FileLimiter) updateBucket(scope limitScope, flag int, update func(*tokenBucket) bool) (bool, error) {
+	file, err := lockFile(l.path(scope, ".rate"), flag, false)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	bucket, err := readBucket(file)
+	if err != nil {
+		return false, err
+	}
+
+	ok := update(bucket)
+
+	if err := file.Truncate(0); err != nil {
+		return false, err
+	}
+
+	if _, err := file.WriteAt([]byte(fmt.Sprintf("%v %v", bucket.tokens, bucket.last.UnixNano())), 0); err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+func readBucket(file *os.File) (*tokenBucket, error) {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := &tokenBucket{}
+
+	// starts over with a full bucket when the file is new or mangled
+	if fields := strings.Fields(string(data)); len(fields) == 2 {
+		tokens, err1 := strconv.ParseFloat(fields[0], 64)
+		last, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 == nil && err2 == nil {
+			bucket.tokens = tokens
+			bucket.last = time.Unix(0, last)
+		}
+	}
+
+	return bucket, nil
+}
+
+// staleAfter is how long it takes an empty bucket to refill, but at least a
+// minute. Unused slot files are kept that long, and prune runs that often.
+func (l *FileLimiter) staleAfter() time.Duration {
+	window := time.Minute
+
+	if l.Limits.Rate > 0 {
+		if refill := time.Duration(float64(l.Limits.burst()) / l.Limits.Rate * float64(time.Second)); refill > window {
+			window = refill
+		}
+	}
+
+	return window
+}
+
+// prune removes rate files of refilled buckets, which are no different from
+// missing ones, and unlocked slot files not used for staleAfter. It runs at
+// most once per staleAfter (across processes) and ignores errors, as the
+// files are only a matter of disk usage.
+func (l *FileLimiter) prune() {
+	now := l.now()
+	marker := filepath.Join(l.Dir, ".pruned")
+
+	if info, err := os.Stat(marker); err == nil && now.Sub(info.ModTime()) < l.staleAfter() {
+		return
+	}
+
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		return
+	}
+	os.Chtimes(marker, now, now)
+
+	infos, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		path := filepath.Join(l.Dir, info.Name())
+
+		switch filepath.Ext(path) {
+		case ".rate":
+			l.pruneRateFile(path, now)
+		case ".slot":
+			if now.Sub(info.ModTime()) >= l.staleAfter() {
+				pruneSlotFile(path)
+			}
+		}
+	}
+}
+
+func (l *FileLimiter) pruneRateFile(path string, now time.Time) {
+	file, err := lockFile(path, os.O_RDONLY, false)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	bucket, err := readBucket(file)
+	if err != nil {
+		return
+	}
+
+	// rate limits disabled since the file was written count as refilled
+	if l.Limits.Rate > 0 && !bucket.last.IsZero() {
+		bucket.refill(l.Limits.Rate, l.Limits.burst(), now)
+		if bucket.tokens < float64(l.Limits.burst()) {
+			return
+		}
+	}
+
+	os.Remove(path) // while locked
+}
+
+func pruneSlotFile(path string) {
+	file, err := lockFile(path, os.O_RDONLY, true)
+	if err != nil || file == nil {
+		return
+	}
+	defer file.Close()
+
+	os.Remove(path) // while locked
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectLimitError(t *testing.T, err error, scope string, rateLimited bool) {
+	limitErr, ok := err.(*LimitError)
+	if !ok {
+		t.Errorf("expected *LimitError, got %v", err)
+		return
+	}
+
+	if limitErr.Scope != scope || limitErr.RateLimited != rateLimited {
+		t.Errorf("expected %v limit error (rate limited: %v), got %v", scope, rateLimited, limitErr)
+	}
+}
+
+// testConcurrencyLimits checks limiters created by newLimiter, which must
+// share state between calls.
+func testConcurrencyLimits(t *testing.T, newLimiter func(Limits) Limiter) {
+	limits := Limits{MaxPerUser: 2, MaxPerIp: 3, MaxPerRepo: 1}
+
+	releaseFoo, err := newLimiter(limits).Acquire(LimitKey{User: "sickill", Ip: "1.2.3.4", Repo: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newLimiter(limits).Acquire(LimitKey{User: "ajax", Ip: "5.6.7.8", Repo: "foo"})
+	expectLimitError(t, err, "repo", false)
+
+	releaseBar, err := newLimiter(limits).Acquire(LimitKey{User: "sickill", Ip: "1.2.3.4", Repo: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newLimiter(limits).Acquire(LimitKey{User: "sickill", Ip: "1.2.3.4", Repo: "baz"})
+	expectLimitError(t, err, "user", false)
+
+	// anonymous
+	releaseBaz, err := newLimiter(limits).Acquire(LimitKey{Ip: "1.2.3.4", Repo: "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newLimiter(limits).Acquire(LimitKey{Ip: "1.2.3.4", Repo: "qux"})
+	expectLimitError(t, err, "ip", false)
+
+	releaseFoo()
+	releaseBaz()
+
+	release, err := newLimiter(limits).Acquire(LimitKey{User: "ajax", Ip: "5.6.7.8", Repo: "foo"})
+	if err != nil {
+		t.Errorf("expected released slots to be available, got %v", err)
+	} else {
+		release()
+	}
+
+	releaseBar()
+}
+
+func testRateLimits(t *testing.T, limiter Limiter, now *time.Time) {
+	for i := 0; i < 2; i++ {
+		release, err := limiter.Acquire(LimitKey{User: "sickill", Ip: "1.2.3.4"})
+		if err != nil {
+			t.Fatalf("expected burst of 2 requests to be allowed, got %v", err)
+		}
+		release()
+	}
+
+	_, err := limiter.Acquire(LimitKey{User: "sickill", Ip: "5.6.7.8"})
+	expectLimitError(t, err, "user", true)
+
+	_, err = limiter.Acquire(LimitKey{Ip: "1.2.3.4"})
+	expectLimitError(t, err, "ip", true)
+
+	*now = now.Add(time.Second)
+
+	if _, err := limiter.Acquire(LimitKey{User: "sickill", Ip: "5.6.7.8"}); err != nil {
+		t.Errorf("expected bucket to be refilled, got %v", err)
+	}
+}
+
+// testRejectedKeepsTokens checks that operations rejected by one limit don't
+// use up tokens of the others.
+func testRejectedKeepsTokens(t *testing.T, limiter Limiter) {
+	release, err := limiter.Acquire(LimitKey{User: "sickill", Ip: "1.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = limiter.Acquire(LimitKey{User: "sickill", Ip: "1.2.3.4"})
+	expectLimitError(t, err, "user", false)
+
+	release()
+
+	// the last token of 1.2.3.4
+	if release, err := limiter.Acquire(LimitKey{User: "sickill", Ip: "1.2.3.4"}); err != nil {
+		t.Errorf("expected token to be kept after concurrency limit rejection, got %v", err)
+	} else {
+		release()
+	}
+
+	_, err = limiter.Acquire(LimitKey{User: "ajax", Ip: "1.2.3.4"})
+	expectLimitError(t, err, "ip", true)
+
+	for i := 0; i < 2; i++ {
+		if release, err := limiter.Acquire(LimitKey{User: "ajax", Ip: "5.6.7.8"}); err != nil {
+			t.Errorf("expected token to be kept after rate limit rejection, got %v", err)
+		} else {
+			release()
+		}
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	limiter := NewMemoryLimiter(Limits{MaxPerUser: 2, MaxPerIp: 3, MaxPerRepo: 1})
+
+	testConcurrencyLimits(t, func(Limits) Limiter { return limiter })
+}
+
+func TestMemoryLimiter_Rate(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+
+	limiter := NewMemoryLimiter(Limits{Rate: 1, Burst: 2})
+	limiter.now = func() time.Time { return now }
+
+	testRateLimits(t, limiter, &now)
+}
+
+func TestMemoryLimiter_RejectedKeepsTokens(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+
+	limiter := NewMemoryLimiter(Limits{MaxPerUser: 1, Rate: 0.001, Burst: 2})
+	limiter.now = func() time.Time { return now }
+
+	testRejectedKeepsTokens(t, limiter)
+}
+
+func TestFileLimiter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "limits")
+	defer os.RemoveAll(dir)
+
+	// a new limiter for each call, like in separate processes
+	testConcurrencyLimits(t, func(limits Limits) Limiter {
+		limiter, err := NewFileLimiter(limits, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return limiter
+	})
+}
+
+func TestFileLimiter_Rate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "limits")
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1400000000, 0)
+
+	limiter, err := NewFileLimiter(Limits{Rate: 1, Burst: 2}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.now = func() time.Time { return now }
+
+	testRateLimits(t, limiter, &now)
+}
+
+func TestFileLimiter_RejectedKeepsTokens(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "limits")
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1400000000, 0)
+
+	limiter, err := NewFileLimiter(Limits{MaxPerUser: 1, Rate: 0.001, Burst: 2}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.now = func() time.Time { return now }
+
+	testRejectedKeepsTokens(t, limiter)
+}
+
+func TestFileLimiter_Prune(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "limits")
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1400000000, 0)
+
+	// refills in 2 minutes
+	limiter, err := NewFileLimiter(Limits{MaxPerUser: 1, Rate: 1.0 / 60, Burst: 2}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.now = func() time.Time { return now }
+
+	release, _ := limiter.Acquire(LimitKey{User: "sickill"})
+	release()
+	held, _ := limiter.Acquire(LimitKey{User: "ajax"})
+	defer held()
+
+	count := func(pattern string) int {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		return len(matches)
+	}
+
+	var tests = []struct {
+		after         time.Duration
+		expectedRates int
+		expectedSlots int
+	}{
+		{time.Minute, 2, 2},     // not pruned yet
+		{2 * time.Minute, 0, 1}, // refilled and unused, except the held slot
+	}
+
+	for _, test := range tests {
+		now = time.Unix(1400000000, 0).Add(test.after)
+		limiter.prune()
+
+		if rates, slots := count("*.rate"), count("*.slot"); rates != test.expectedRates || slots != test.expectedSlots {
+			t.Errorf("expected %v rate and %v slot files, got %v and %v (%v)", test.expectedRates, test.expectedSlots, rates, slots, test)
+		}
+	}
+
+	// a new slot file is created for the user
+	if release, err := limiter.Acquire(LimitKey{User: "sickill"}); err != nil {
+		t.Errorf("expected pruned slot to be available, got %v", err)
+	} else {
+		release()
+	}
+
+	if _, err := limiter.Acquire(LimitKey{User: "ajax"}); err == nil {
+		t.Errorf("expected held slot to be kept")
+	}
+}
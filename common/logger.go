@@ -1,19 +1,215 @@
 package common
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Logger interface {
 	Printf(string, ...interface{})
 }
 
+// StructuredLogger logs messages with typed fields attached, so they can be
+// processed without parsing free-form text.
+type StructuredLogger interface {
+	Logger
+	Log(message string, fields ...Field)
+}
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func User(username string) Field {
+	return Field{"user", username}
+}
+
+func Repo(repoPath string) Field {
+	return Field{"repo", repoPath}
+}
+
+func Protocol(protocol string) Field {
+	return Field{"protocol", protocol}
+}
+
+func Command(command string) Field {
+	return Field{"command", command}
+}
+
+// Duration is logged in seconds.
+func Duration(d time.Duration) Field {
+	return Field{"duration", d.Seconds()}
+}
+
+func BytesIn(n int64) Field {
+	return Field{"bytes_in", n}
+}
+
+func BytesOut(n int64) Field {
+	return Field{"bytes_out", n}
+}
+
+func ExitStatus(status int) Field {
+	return Field{"exit_status", status}
+}
+
+// ExitReason is a short, machine-friendly reason the session ended, like
+// "ok" or "access_denied".
+func ExitReason(reason string) Field {
+	return Field{"exit_reason", reason}
+}
+
+// Status is HTTP response status.
+func Status(status int) Field {
+	return Field{"status", status}
+}
+
+func Err(err error) Field {
+	if err == nil {
+		return Field{"error", nil}
+	}
+
+	return Field{"error", err.Error()}
+}
+
+type LogFormat string
+
+const (
+	LogFormatText   LogFormat = "text" // "[<session id>] <message> key=value..."
+	LogFormatJson   LogFormat = "json"
+	LogFormatLogfmt LogFormat = "logfmt"
+)
+
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch format := LogFormat(s); format {
+	case LogFormatText, LogFormatJson, LogFormatLogfmt:
+		return format, nil
+	}
+
+	return "", errors.New(fmt.Sprintf(`invalid log format "%v"`, s))
+}
+
+// NewTargetLogger returns a logger suitable as SessionLogger's target for the
+// given format. Structured formats carry their own timestamp.
+func NewTargetLogger(w io.Writer, format LogFormat) *log.Logger {
+	if format == LogFormatJson || format == LogFormatLogfmt {
+		return log.New(w, "", 0)
+	}
+
+	return log.New(w, "", log.LstdFlags)
+}
+
 type SessionLogger struct {
 	Target    *log.Logger
 	SessionId string
+	Format    LogFormat // defaults to LogFormatText
+
+	now func() time.Time
 }
 
 func (l *SessionLogger) Printf(format string, args ...interface{}) {
-	l.Target.Printf("[%v] %v", l.SessionId, fmt.Sprintf(format, args...))
+	l.Log(fmt.Sprintf(format, args...))
+}
+
+func (l *SessionLogger) Log(message string, fields ...Field) {
+	switch l.Format {
+	case LogFormatJson:
+		l.Target.Print(l.formatJson(message, fields))
+	case LogFormatLogfmt:
+		l.Target.Print(l.formatLogfmt(message, fields))
+	default:
+		l.Target.Print(l.formatText(message, fields))
+	}
+}
+
+func (l *SessionLogger) currentTime() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+
+	return time.Now()
+}
+
+func (l *SessionLogger) header(message string) []Field {
+	return []Field{
+		{"time", l.currentTime().UTC().Format(time.RFC3339Nano)},
+		{"session", l.SessionId},
+		{"msg", message},
+	}
+}
+
+func (l *SessionLogger) formatText(message string, fields []Field) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%v] %v", l.SessionId, message)
+
+	for _, field := range fields {
+		buf.WriteString(" ")
+		writeLogfmtField(&buf, field)
+	}
+
+	return buf.String()
+}
+
+func (l *SessionLogger) formatJson(message string, fields []Field) string {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+
+	// written by hand to keep the order of fields
+	for i, field := range append(l.header(message), fields...) {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		key, _ := json.Marshal(field.Key)
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprintf("%v", field.Value))
+		}
+
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+
+	buf.WriteString("}")
+
+	return buf.String()
+}
+
+func (l *SessionLogger) formatLogfmt(message string, fields []Field) string {
+	var buf bytes.Buffer
+
+	for i, field := range append(l.header(message), fields...) {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+
+		writeLogfmtField(&buf, field)
+	}
+
+	return buf.String()
+}
+
+func writeLogfmtField(buf *bytes.Buffer, field Field) {
+	buf.WriteString(field.Key)
+	buf.WriteString("=")
+
+	if field.Value == nil {
+		return
+	}
+
+	value := fmt.Sprintf("%v", field.Value)
+	if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+		value = strconv.Quote(value)
+	}
+
+	buf.WriteString(value)
 }
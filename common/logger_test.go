@@ -0,0 +1,64 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestSessionLogger_Log(t *testing.T) {
+	var tests = []struct {
+		format   LogFormat
+		expected string
+	}{
+		{LogFormatText, `[1.2.3.4] session finished user=sickill repo=foo/bar.git duration=1.5 exit_status=1 error="connection refused"` + "\n"},
+		{LogFormatJson, `{"time":"2014-05-13T16:53:20Z","session":"1.2.3.4","msg":"session finished","user":"sickill","repo":"foo/bar.git","duration":1.5,"exit_status":1,"error":"connection refused"}` + "\n"},
+		{LogFormatLogfmt, `time=2014-05-13T16:53:20Z session=1.2.3.4 msg="session finished" user=sickill repo=foo/bar.git duration=1.5 exit_status=1 error="connection refused"` + "\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		logger := &SessionLogger{Target: log.New(&buf, "", 0), SessionId: "1.2.3.4", Format: test.format}
+		logger.now = func() time.Time { return time.Unix(1400000000, 0) }
+
+		logger.Log("session finished", User("sickill"), Repo("foo/bar.git"), Duration(1500*time.Millisecond), ExitStatus(1), Err(errors.New("connection refused")))
+
+		if buf.String() != test.expected {
+			t.Errorf("expected %q, got %q (%v)", test.expected, buf.String(), test.format)
+		}
+	}
+}
+
+func TestSessionLogger_Printf(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &SessionLogger{Target: log.New(&buf, "", 0), SessionId: "1.2.3.4"}
+
+	logger.Printf("user authenticated as %v", "sickill")
+
+	if buf.String() != "[1.2.3.4] user authenticated as sickill\n" {
+		t.Errorf("expected free-form text format to be kept by default, got %q", buf.String())
+	}
+
+	buf.Reset()
+	logger.Format = LogFormatJson
+	logger.now = func() time.Time { return time.Unix(1400000000, 0) }
+
+	logger.Printf(`invoking git-shell with command "%v"`, "git-upload-pack '/repos/1.git'")
+
+	expected := `{"time":"2014-05-13T16:53:20Z","session":"1.2.3.4","msg":"invoking git-shell with command \"git-upload-pack '/repos/1.git'\""}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	if format, err := ParseLogFormat("logfmt"); format != LogFormatLogfmt || err != nil {
+		t.Errorf("expected logfmt format, got %v (error: %v)", format, err)
+	}
+
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const DefaultMaintenanceFile = "/etc/gitorious/maintenance"
+
+type MaintenanceMode string
+
+const (
+	MaintenanceReadOnly MaintenanceMode = "read-only" // pushes are rejected
+	MaintenanceFull     MaintenanceMode = "full"      // everything is rejected
+)
+
+type Maintenance struct {
+	Mode    MaintenanceMode
+	Message string // shown to the user
+}
+
+const (
+	defaultReadOnlyMessage = "Pushing is temporarily disabled for maintenance, please try again later"
+	defaultFullMessage     = "Gitorious is down for maintenance, please try again later"
+)
+
+// ReadMaintenance reads the maintenance flag file: the mode on the first line
+// (read-only when empty), optionally followed by a message for the users. It
+// returns nil when the file doesn't exist. When the file exists but can't be
+// read or has invalid mode, read-only mode is returned along with the error,
+// as pushing during maintenance is worse than not pushing because of a typo.
+func ReadMaintenance(path string) (*Maintenance, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return &Maintenance{Mode: MaintenanceReadOnly, Message: defaultReadOnlyMessage}, err
+	}
+
+	lines := strings.SplitN(string(data), "\n", 2)
+	maintenance := &Maintenance{Mode: MaintenanceMode(strings.TrimSpace(lines[0]))}
+
+	if len(lines) > 1 {
+		maintenance.Message = strings.TrimSpace(lines[1])
+	}
+
+	switch maintenance.Mode {
+	case "", MaintenanceReadOnly:
+		maintenance.Mode = MaintenanceReadOnly
+	case MaintenanceFull:
+	default:
+		err = errors.New(fmt.Sprintf(`invalid maintenance mode "%v" in %v`, maintenance.Mode, path))
+		maintenance.Mode = MaintenanceReadOnly
+	}
+
+	if maintenance.Message == "" {
+		if maintenance.Mode == MaintenanceFull {
+			maintenance.Message = defaultFullMessage
+		} else {
+			maintenance.Message = defaultReadOnlyMessage
+		}
+	}
+
+	return maintenance, err
+}
+
+// Rejects tells whether an operation (push or not) is rejected.
+func (m *Maintenance) Rejects(isPush bool) bool {
+	if m == nil {
+		return false
+	}
+
+	return m.Mode == MaintenanceFull || isPush
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadMaintenance(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "maintenance")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "maintenance")
+
+	var tests = []struct {
+		content             *string
+		expectedMaintenance *Maintenance
+		expectedError       bool
+	}{
+		{nil, nil, false},
+		{strPtr(""), &Maintenance{MaintenanceReadOnly, "Pushing is temporarily disabled for maintenance, please try again later"}, false},
+		{strPtr("read-only\n"), &Maintenance{MaintenanceReadOnly, "Pushing is temporarily disabled for maintenance, please try again later"}, false},
+		{strPtr("read-only\nMigrating storage until 5pm UTC\n"), &Maintenance{MaintenanceReadOnly, "Migrating storage until 5pm UTC"}, false},
+		{strPtr("full"), &Maintenance{MaintenanceFull, "Gitorious is down for maintenance, please try again later"}, false},
+		{strPtr("full\nBack soon!"), &Maintenance{MaintenanceFull, "Back soon!"}, false},
+		// fails closed
+		{strPtr("readonly"), &Maintenance{MaintenanceReadOnly, "Pushing is temporarily disabled for maintenance, please try again later"}, true},
+		{strPtr("ful\nBack soon!"), &Maintenance{MaintenanceReadOnly, "Back soon!"}, true},
+	}
+
+	for _, test := range tests {
+		os.RemoveAll(path)
+		if test.content != nil {
+			ioutil.WriteFile(path, []byte(*test.content), 0644)
+		}
+
+		maintenance, err := ReadMaintenance(path)
+
+		if !reflect.DeepEqual(maintenance, test.expectedMaintenance) {
+			t.Errorf("expected %v, got %v (%v)", test.expectedMaintenance, maintenance, test)
+		}
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("expected error %v, got %v (%v)", test.expectedError, err, test)
+		}
+	}
+}
+
+func TestReadMaintenance_Unreadable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "maintenance")
+	defer os.RemoveAll(dir)
+
+	// a directory can't be read as a file, even by root
+	maintenance, err := ReadMaintenance(dir)
+
+	if err == nil || maintenance == nil || maintenance.Mode != MaintenanceReadOnly {
+		t.Errorf("expected read-only mode with error, got %v (error: %v)", maintenance, err)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestMaintenance_Rejects(t *testing.T) {
+	var tests = []struct {
+		maintenance *Maintenance
+		isPush      bool
+		expected    bool
+	}{
+		{nil, false, false},
+		{nil, true, false},
+		{&Maintenance{Mode: MaintenanceReadOnly}, false, false},
+		{&Maintenance{Mode: MaintenanceReadOnly}, true, true},
+		{&Maintenance{Mode: MaintenanceFull}, false, true},
+		{&Maintenance{Mode: MaintenanceFull}, true, true},
+	}
+
+	for _, test := range tests {
+		if rejects := test.maintenance.Rejects(test.isPush); rejects != test.expected {
+			t.Errorf("expected %v, got %v (%v)", test.expected, rejects, test)
+		}
+	}
+}
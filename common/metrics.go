@@ -0,0 +1,255 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets (in seconds) covering both quick API
+// calls and long clones.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and exposes them in Prometheus text format.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := r.metrics
+	r.mutex.Unlock()
+
+	buf := bufio.NewWriter(w)
+
+	for _, m := range metrics {
+		m.write(buf)
+	}
+
+	return buf.Flush()
+}
+
+// Handler serves the metrics for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+// metricVec keeps values of a metric per combination of label values.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+	buckets     []float64 // upper bounds, histograms only
+	counts      []uint64  // per bucket, histograms only
+	count       uint64    // histograms only
+}
+
+func newMetricVec(name, help, kind string, labels []string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: map[string]*metricValue{}}
+}
+
+// with calls f with value for the given label values, holding the lock.
+func (v *metricVec) with(labelValues []string, buckets []float64, f func(*metricValue)) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("%v expects %v label values, got %v", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	value, ok := v.values[key]
+	if !ok {
+		value = &metricValue{labelValues: append([]string(nil), labelValues...), buckets: buckets}
+		if buckets != nil {
+			value.counts = make([]uint64, len(buckets))
+		}
+		v.values[key] = value
+	}
+
+	f(value)
+}
+
+func (v *metricVec) write(w *bufio.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := v.values[key]
+		labels := formatLabels(v.labels, value.labelValues)
+
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", v.name, labels, formatValue(value.value))
+			continue
+		}
+
+		for i, upperBound := range value.buckets {
+			bucketLabels := formatLabels(append(v.labels, "le"), append(value.labelValues, formatValue(upperBound)))
+			fmt.Fprintf(w, "%v_bucket%v %v\n", v.name, bucketLabels, value.counts[i])
+		}
+
+		infLabels := formatLabels(append(v.labels, "le"), append(value.labelValues, "+Inf"))
+		fmt.Fprintf(w, "%v_bucket%v %v\n", v.name, infLabels, value.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", v.name, labels, formatValue(value.value))
+		fmt.Fprintf(w, "%v_count%v %v\n", v.name, labels, value.count)
+	}
+}
+
+type CounterVec struct {
+	vec *metricVec
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newMetricVec(name, help, "counter", labels)}
+	r.register(c.vec)
+
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.vec.with(labelValues, nil, func(v *metricValue) { v.value += delta })
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+type GaugeVec struct {
+	vec *metricVec
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newMetricVec(name, help, "gauge", labels)}
+	r.register(g.vec)
+
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.with(labelValues, nil, func(v *metricValue) { v.value = value })
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.vec.with(labelValues, nil, func(v *metricValue) { v.value += delta })
+}
+
+type HistogramVec struct {
+	vec     *metricVec
+	buckets []float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newMetricVec(name, help, "histogram", labels), buckets}
+	r.register(h.vec)
+
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.vec.with(labelValues, h.buckets, func(v *metricValue) {
+		for i, upperBound := range v.buckets {
+			if value <= upperBound {
+				v.counts[i]++
+			}
+		}
+
+		v.count++
+		v.value += value
+	})
+}
+
+// gaugeFunc is a gauge with value read at scrape time.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	r.register(&gaugeFunc{name, help, value})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", g.name, escapeHelp(g.help))
+	fmt.Fprintf(w, "# TYPE %v gauge\n", g.name)
+	fmt.Fprintf(w, "%v %v\n", g.name, formatValue(g.value()))
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%v="%v"`, name, escapeLabelValue(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
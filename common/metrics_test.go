@@ -0,0 +1,68 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := NewRegistry()
+
+	counter := registry.NewCounterVec("requests_total", "Number of requests.", "service", "status")
+	counter.Inc("upload-pack", "200")
+	counter.Inc("upload-pack", "200")
+	counter.Add(3, "receive-pack", "403")
+
+	gauge := registry.NewGaugeVec("temperature", "Current\ntemperature.", "room")
+	gauge.Set(21.5, `the "big" one`)
+
+	histogram := registry.NewHistogramVec("duration_seconds", "Request duration.", []float64{0.1, 1}, "service")
+	histogram.Observe(0.05, "upload-pack")
+	histogram.Observe(0.5, "upload-pack")
+	histogram.Observe(2, "upload-pack")
+
+	registry.NewGaugeFunc("in_flight", "Processes running.", func() float64 { return 2 })
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"# HELP requests_total Number of requests.",
+		"# TYPE requests_total counter",
+		`requests_total{service="receive-pack",status="403"} 3`,
+		`requests_total{service="upload-pack",status="200"} 2`,
+		`# HELP temperature Current\ntemperature.`,
+		"# TYPE temperature gauge",
+		`temperature{room="the \"big\" one"} 21.5`,
+		"# HELP duration_seconds Request duration.",
+		"# TYPE duration_seconds histogram",
+		`duration_seconds_bucket{service="upload-pack",le="0.1"} 1`,
+		`duration_seconds_bucket{service="upload-pack",le="1"} 2`,
+		`duration_seconds_bucket{service="upload-pack",le="+Inf"} 3`,
+		`duration_seconds_sum{service="upload-pack"} 2.55`,
+		`duration_seconds_count{service="upload-pack"} 3`,
+		"# HELP in_flight Processes running.",
+		"# TYPE in_flight gauge",
+		"in_flight 2",
+		"",
+	}, "\n")
+
+	if buf.String() != expected {
+		t.Errorf("expected:\n%v\ngot:\n%v", expected, buf.String())
+	}
+}
+
+func TestCounterVec_InvalidLabels(t *testing.T) {
+	counter := NewRegistry().NewCounterVec("requests_total", "Number of requests.", "service")
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on wrong number of label values")
+		}
+	}()
+
+	counter.Inc("upload-pack", "200")
+}
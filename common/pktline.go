@@ -0,0 +1,55 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const maxPacketLength = 65520
+
+// WritePacket writes s to w in git's pkt-line format.
+func WritePacket(w io.Writer, s string) error {
+	if len(s)+4 > maxPacketLength {
+		return errors.New(fmt.Sprintf("packet too long (%v bytes)", len(s)))
+	}
+
+	_, err := fmt.Fprintf(w, "%04x%v", len(s)+4, s)
+	return err
+}
+
+// WriteFlushPacket writes git's pkt-line flush packet ("0000") to w.
+func WriteFlushPacket(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// ReadPacket reads a single pkt-line from r. Flush packet is returned as an
+// empty string.
+func ReadPacket(r io.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("invalid packet header %q", header))
+	}
+
+	if length == 0 {
+		return "", nil
+	}
+
+	if length < 4 || length > maxPacketLength {
+		return "", errors.New(fmt.Sprintf("invalid packet length %v", length))
+	}
+
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", err
+	}
+
+	return string(payload), nil
+}
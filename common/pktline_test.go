@@ -0,0 +1,50 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWritePacket(t *testing.T) {
+	var buf bytes.Buffer
+
+	WritePacket(&buf, "# service=git-upload-pack\n")
+	WriteFlushPacket(&buf)
+
+	expected := "001e# service=git-upload-pack\n0000"
+	if buf.String() != expected {
+		t.Errorf(`expected "%v", got "%v"`, expected, buf.String())
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	var tests = []struct {
+		input           string
+		expectedPayload string
+		expectedError   bool
+	}{
+		{"0033git-upload-pack /project.git\x00host=myserver.com\x00", "git-upload-pack /project.git\x00host=myserver.com\x00", false},
+		{"0000", "", false},
+		{"0009hello", "hello", false},
+		{"0009hell", "", true},
+		{"zzzzhello", "", true},
+		{"0003", "", true},
+		{"00", "", true},
+	}
+
+	for _, test := range tests {
+		payload, err := ReadPacket(bytes.NewBufferString(test.input))
+
+		if payload != test.expectedPayload {
+			t.Errorf("expected payload %q, got %q (%v)", test.expectedPayload, payload, test)
+		}
+
+		var errorHappened bool
+		if err != nil {
+			errorHappened = true
+		}
+		if errorHappened != test.expectedError {
+			t.Errorf("expected error %v (%v)", test.expectedError, test)
+		}
+	}
+}
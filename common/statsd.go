@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StatsdMetric is a StatsD metric with DogStatsD-style tags:
+// "name:value|type|#key:value,key:value".
+type StatsdMetric struct {
+	Name  string
+	Value float64
+	Type  string // "c" (counter), "g" (gauge) or "ms" (timer)
+	Tags  []StatsdTag
+}
+
+type StatsdTag struct {
+	Key   string
+	Value string
+}
+
+// characters with special meaning in the datagram
+var statsdReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_", " ", "_")
+
+func (m *StatsdMetric) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v:%v|%v", m.Name, strconv.FormatFloat(m.Value, 'f', -1, 64), m.Type)
+
+	for i, tag := range m.Tags {
+		if i == 0 {
+			buf.WriteString("|#")
+		} else {
+			buf.WriteString(",")
+		}
+
+		fmt.Fprintf(&buf, "%v:%v", tag.Key, statsdReplacer.Replace(tag.Value))
+	}
+
+	return buf.String()
+}
+
+// Tag returns value of the tag with the given key, empty if not set.
+func (m *StatsdMetric) Tag(key string) string {
+	for _, tag := range m.Tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+
+	return ""
+}
+
+func ParseStatsdMetric(line string) (*StatsdMetric, error) {
+	invalid := errors.New(fmt.Sprintf(`invalid StatsD metric "%v"`, line))
+
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return nil, invalid
+	}
+
+	colon := strings.LastIndex(parts[0], ":")
+	if colon < 1 {
+		return nil, invalid
+	}
+
+	value, err := strconv.ParseFloat(parts[0][colon+1:], 64)
+	if err != nil {
+		return nil, invalid
+	}
+
+	metric := &StatsdMetric{Name: parts[0][:colon], Value: value, Type: parts[1]}
+
+	switch metric.Type {
+	case "c", "g", "ms":
+	default:
+		return nil, invalid
+	}
+
+	for _, part := range parts[2:] {
+		if !strings.HasPrefix(part, "#") { // sample rate, ignored
+			continue
+		}
+
+		for _, tag := range strings.Split(part[1:], ",") {
+			keyValue := strings.SplitN(tag, ":", 2)
+			if len(keyValue) == 2 {
+				metric.Tags = append(metric.Tags, StatsdTag{keyValue[0], keyValue[1]})
+			} else {
+				metric.Tags = append(metric.Tags, StatsdTag{keyValue[0], ""})
+			}
+		}
+	}
+
+	return metric, nil
+}
+
+// parseStatsdAddr splits "udp://host:port" or "unix:///path/to/socket" into
+// network and address. Address without a scheme is UDP.
+func parseStatsdAddr(addr string) (string, string) {
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		return "udp", strings.TrimPrefix(addr, "udp://")
+	case strings.HasPrefix(addr, "unix://"):
+		return "unixgram", strings.TrimPrefix(addr, "unix://")
+	}
+
+	return "udp", addr
+}
+
+// StatsdClient sends metrics to a StatsD sink over UDP or unix datagram
+// socket.
+type StatsdClient struct {
+	conn net.Conn
+}
+
+func DialStatsd(addr string) (*StatsdClient, error) {
+	network, address := parseStatsdAddr(addr)
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsdClient{conn}, nil
+}
+
+// Send sends metrics in a single datagram.
+func (c *StatsdClient) Send(metrics ...*StatsdMetric) error {
+	lines := make([]string, len(metrics))
+	for i, metric := range metrics {
+		lines[i] = metric.String()
+	}
+
+	_, err := c.conn.Write([]byte(strings.Join(lines, "\n")))
+	return err
+}
+
+func (c *StatsdClient) Close() error {
+	return c.conn.Close()
+}
+
+// ListenStatsd listens for datagrams on an address in the format accepted by
+// DialStatsd, replacing a stale unix socket.
+func ListenStatsd(addr string) (net.PacketConn, error) {
+	network, address := parseStatsdAddr(addr)
+
+	if network == "unixgram" {
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	return net.ListenPacket(network, address)
+}
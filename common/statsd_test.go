@@ -0,0 +1,95 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStatsdMetric_String(t *testing.T) {
+	var tests = []struct {
+		metric   StatsdMetric
+		expected string
+	}{
+		{StatsdMetric{Name: "sessions", Value: 1, Type: "c"}, "sessions:1|c"},
+		{StatsdMetric{Name: "duration", Value: 12.5, Type: "ms"}, "duration:12.5|ms"},
+		{StatsdMetric{Name: "sessions", Value: 1, Type: "c", Tags: []StatsdTag{{"command", "upload-pack"}, {"user", "evil,user|#x"}}}, "sessions:1|c|#command:upload-pack,user:evil_user__x"},
+	}
+
+	for _, test := range tests {
+		if s := test.metric.String(); s != test.expected {
+			t.Errorf("expected %q, got %q (%v)", test.expected, s, test)
+		}
+	}
+}
+
+func TestParseStatsdMetric(t *testing.T) {
+	var tests = []struct {
+		line           string
+		expectedMetric *StatsdMetric
+	}{
+		{"sessions:1|c", &StatsdMetric{Name: "sessions", Value: 1, Type: "c"}},
+		{"duration:12.5|ms|@0.5", &StatsdMetric{Name: "duration", Value: 12.5, Type: "ms"}},
+		{"sessions:1|c|#command:upload-pack,flag", &StatsdMetric{Name: "sessions", Value: 1, Type: "c", Tags: []StatsdTag{{"command", "upload-pack"}, {"flag", ""}}}},
+		{"sessions:1", nil},
+		{"sessions|c", nil},
+		{":1|c", nil},
+		{"sessions:x|c", nil},
+		{"sessions:1|s", nil},
+	}
+
+	for _, test := range tests {
+		metric, err := ParseStatsdMetric(test.line)
+
+		if test.expectedMetric == nil {
+			if err == nil {
+				t.Errorf("expected error, got %v (%v)", metric, test)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(metric, test.expectedMetric) {
+			t.Errorf("expected %v, got %v (%v)", test.expectedMetric, metric, test)
+		}
+	}
+}
+
+func TestStatsdClient_Send(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "statsd")
+	defer os.RemoveAll(dir)
+
+	addr := "unix://" + filepath.Join(dir, "metrics.sock")
+
+	conn, err := ListenStatsd(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := DialStatsd(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.Send(
+		&StatsdMetric{Name: "sessions", Value: 1, Type: "c"},
+		&StatsdMetric{Name: "duration", Value: 5, Type: "ms", Tags: []StatsdTag{{"command", "upload-pack"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "sessions:1|c\nduration:5|ms|#command:upload-pack"
+	if string(buf[:n]) != expected {
+		t.Errorf("expected %q, got %q", expected, buf[:n])
+	}
+}
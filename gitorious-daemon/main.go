@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+const requestTimeout = 30 * time.Second
+
+func say(w io.Writer, s string, args ...interface{}) {
+	// "ERR" packet is displayed by git client as "fatal: remote error: ..."
+	common.WritePacket(w, fmt.Sprintf("ERR %v\n", fmt.Sprintf(s, args...)))
+}
+
+var requestRegexp = regexp.MustCompile("^(git-(?:receive-pack|upload-pack|upload-archive)) /?([^/\x00\n][^\x00\n]*)\n?(?:\x00|$)")
+
+func parseRequest(request string) (string, string, error) {
+	matches := requestRegexp.FindStringSubmatch(request)
+	if matches == nil {
+		return "", "", errors.New(fmt.Sprintf("invalid git-daemon request %q", request))
+	}
+
+	return matches[1], matches[2], nil
+}
+
+func createGitEnv(repoConfig *api.RepoConfig) []string {
+	return common.CreateEnv("git", "", repoConfig)
+}
+
+func execGitUploadPack(fullRepoPath string, env []string, stdin io.Reader, stdout io.Writer) (string, error) {
+	cmd := exec.Command("git", "upload-pack", "--strict", fullRepoPath)
+	cmd.Env = env
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+
+	if err := cmd.Run(); err != nil {
+		return strings.Trim(stderrBuf.String(), " \n"), err
+	}
+
+	return "", nil
+}
+
+type Server struct {
+	logger      *log.Logger
+	internalApi api.InternalApi
+}
+
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	// don't let idle clients hold the connection before sending a request
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+
+	s.serve(conn, conn, conn.RemoteAddr().String())
+}
+
+func (s *Server) serve(stdin io.Reader, stdout io.Writer, clientId string) {
+	logger := &common.SessionLogger{Target: s.logger, SessionId: clientId}
+
+	logger.Printf("client connected")
+
+	request, err := common.ReadPacket(stdin)
+	if err != nil {
+		logger.Printf("error reading request: %v, disconnecting...", err)
+		return
+	}
+
+	// fetch negotiation may legitimately take long, lift the request deadline
+	if conn, ok := stdin.(net.Conn); ok {
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	logger.Printf("processing request: %q", request)
+
+	command, repoPath, err := parseRequest(request)
+	if err != nil {
+		say(stdout, "Invalid command")
+		logger.Printf("%v, disconnecting...", err)
+		return
+	}
+
+	if command != "git-upload-pack" {
+		if command == "git-receive-pack" {
+			say(stdout, "Pushing over git:// is not supported, please use SSH or HTTP")
+		} else {
+			say(stdout, "Invalid command")
+		}
+		logger.Printf("denying %v, disconnecting...", command)
+		return
+	}
+
+	repoConfig, err := s.internalApi.GetRepoConfig(repoPath, "")
+	if err != nil {
+		if httpErr, ok := err.(*api.HttpError); ok {
+			if httpErr.StatusCode == 403 {
+				say(stdout, "Access denied")
+				logger.Printf("%v, disconnecting...", err)
+				return
+			} else if httpErr.StatusCode == 404 {
+				say(stdout, "Invalid repository path")
+				logger.Printf("%v, disconnecting...", err)
+				return
+			}
+		}
+
+		if _, ok := err.(*api.UnavailableError); ok {
+			say(stdout, "Service temporarily unavailable, please try again later")
+			logger.Printf("%v, disconnecting...", err)
+			return
+		}
+
+		say(stdout, "Error occured, please contact support")
+		logger.Printf("%v, disconnecting...", err)
+		return
+	}
+
+	logger.Printf("full repo path: %v", repoConfig.FullPath)
+
+	env := createGitEnv(repoConfig)
+
+	logger.Printf(`invoking git-upload-pack for "%v"`, repoConfig.FullPath)
+
+	if stderr, err := execGitUploadPack(repoConfig.FullPath, env, stdin, stdout); err != nil {
+		logger.Printf("error occured in git-upload-pack: %v", err)
+		logger.Printf("stderr: %v", stderr)
+		return
+	}
+
+	logger.Printf("done")
+}
+
+// invalidateOnSignal drops all cached repository configs on each signal, so
+// changes like revoked access or renamed repository take effect right away.
+func invalidateOnSignal(cache *api.CachingInternalApi, signals <-chan os.Signal, logger *log.Logger) {
+	for range signals {
+		cache.InvalidateAll()
+		logger.Printf("dropped cached repository configs")
+	}
+}
+
+func main() {
+	var (
+		internalApiUrl        = flag.String("api-url", "http://localhost:3000/api/internal", "Gitorious internal API URL")
+		apiConnectTimeout     = flag.Duration("api-connect-timeout", api.DefaultConnectTimeout, "Timeout for connecting to Gitorious internal API")
+		apiReadTimeout        = flag.Duration("api-read-timeout", api.DefaultReadTimeout, "Timeout for reading Gitorious internal API response")
+		apiSecretFile         = flag.String("api-secret-file", os.Getenv("GITORIOUS_INTERNAL_API_SECRET_FILE"), "File with a key for signing Gitorious internal API requests")
+		apiRetries            = flag.Int("api-retries", api.DefaultMaxRetries, "How many times to retry failed Gitorious internal API requests")
+		repoConfigTtl         = flag.Duration("repo-config-ttl", 10*time.Second, "How long to cache repository configs (0 disables caching)")
+		repoConfigNegativeTtl = flag.Duration("repo-config-negative-ttl", 2*time.Second, "How long to cache \"repository not found\" responses")
+		addr                  = flag.String("l", ":9418", "Address/port to listen on")
+	)
+	flag.Parse()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	signingKey, err := api.LoadSigningKey(*apiSecretFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	gitoriousApi := api.NewGitoriousInternalApi(*internalApiUrl)
+	gitoriousApi.ConnectTimeout = *apiConnectTimeout
+	gitoriousApi.ReadTimeout = *apiReadTimeout
+	gitoriousApi.MaxRetries = *apiRetries
+	gitoriousApi.SigningKey = signingKey
+	internalApi := api.NewCachingInternalApi(gitoriousApi, *repoConfigTtl, *repoConfigNegativeTtl)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go invalidateOnSignal(internalApi, signals, logger)
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logger.Printf("listening on %v", *addr)
+
+	server := &Server{logger, internalApi}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Printf("error accepting connection: %v", err)
+			continue
+		}
+
+		go server.ServeConn(conn)
+	}
+}
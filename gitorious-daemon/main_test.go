@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+func TestParseRequest(t *testing.T) {
+	var tests = []struct {
+		request         string
+		expectedCommand string
+		expectedPath    string
+		expectedError   bool
+	}{
+		{"git-upload-pack /the/path.git\x00host=localhost\x00", "git-upload-pack", "the/path.git", false},
+		{"git-upload-pack the/path.git\x00host=localhost\x00", "git-upload-pack", "the/path.git", false},
+		{"git-upload-pack /the/path.git\x00host=localhost\x00\x00version=2\x00", "git-upload-pack", "the/path.git", false},
+		{"git-upload-pack /the/path.git\n", "git-upload-pack", "the/path.git", false},
+		{"git-upload-pack /the/path.git", "git-upload-pack", "the/path.git", false},
+		{"git-receive-pack /the/path.git\x00host=localhost\x00", "git-receive-pack", "the/path.git", false},
+		{"git-upload-archive /the/path.git\x00host=localhost\x00", "git-upload-archive", "the/path.git", false},
+		{"git-upload-pack /\x00host=localhost\x00", "", "", true},
+		{"git-update-ref /the/path.git\x00host=localhost\x00", "", "", true},
+		{"cvs server /the/path.git\x00", "", "", true},
+	}
+
+	for _, test := range tests {
+		command, path, err := parseRequest(test.request)
+
+		if command != test.expectedCommand {
+			t.Errorf("expected command %v, got %v (%q)", test.expectedCommand, command, test.request)
+		}
+
+		if path != test.expectedPath {
+			t.Errorf("expected path %v, got %v (%q)", test.expectedPath, path, test.request)
+		}
+
+		var errorHappened bool
+		if err != nil {
+			errorHappened = true
+		}
+		if errorHappened != test.expectedError {
+			t.Errorf("expected error %v (%q)", test.expectedError, test.request)
+		}
+	}
+}
+
+func prependEnvPath(path string) {
+	oldPath := os.Getenv("PATH")
+	newPath := fmt.Sprintf("%v:%v", path, oldPath)
+	os.Setenv("PATH", newPath)
+}
+
+type testInternalApi struct {
+	repoConfigs map[string]*api.RepoConfig
+	usernames   []string
+}
+
+func (a *testInternalApi) AuthenticateUser(username, password string) (*api.User, error) {
+	return nil, nil
+}
+
+func (a *testInternalApi) AuthenticateToken(token string) (*api.AccessToken, error) {
+	return nil, nil
+}
+
+func (a *testInternalApi) GetRepoConfig(repoPath, username string) (*api.RepoConfig, error) {
+	a.usernames = append(a.usernames, username)
+
+	if repoConfig, ok := a.repoConfigs[repoPath]; ok {
+		return repoConfig, nil
+	}
+
+	if repoPath == "private/repo.git" {
+		return nil, &api.HttpError{Url: &url.URL{Path: "/repo-config"}, StatusCode: 403}
+	}
+
+	return nil, &api.HttpError{Url: &url.URL{Path: "/repo-config"}, StatusCode: 404}
+}
+
+func request(payload string) *bytes.Buffer {
+	var buf bytes.Buffer
+	common.WritePacket(&buf, payload)
+	buf.WriteString("want sha\n")
+
+	return &buf
+}
+
+func TestServer_serve(t *testing.T) {
+	cwd, _ := os.Getwd()
+	prependEnvPath(filepath.Join(cwd, "fixtures", "git-upload-pack"))
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	internalApi := &testInternalApi{
+		repoConfigs: map[string]*api.RepoConfig{
+			"foo/bar.git": &api.RepoConfig{RepositoryId: 123, FullPath: "/full/path/bar.git"},
+		},
+	}
+	server := &Server{logger, internalApi}
+
+	var tests = []struct {
+		request        string
+		expectedOutput string
+	}{
+		{
+			"git-upload-pack /foo/bar.git\x00host=localhost\x00",
+			"upload-pack --strict /full/path/bar.git\nGITORIOUS_PROTO=git\nGITORIOUS_REPOSITORY_ID=123\nGITORIOUS_USER=\nwant sha\n",
+		},
+		{
+			"git-receive-pack /foo/bar.git\x00host=localhost\x00",
+			"0045ERR Pushing over git:// is not supported, please use SSH or HTTP\n",
+		},
+		{
+			"git-upload-archive /foo/bar.git\x00host=localhost\x00",
+			"0018ERR Invalid command\n",
+		},
+		{
+			"git-upload-pack /private/repo.git\x00host=localhost\x00",
+			"0016ERR Access denied\n",
+		},
+		{
+			"git-upload-pack /non/existent.git\x00host=localhost\x00",
+			"0020ERR Invalid repository path\n",
+		},
+		{
+			"rm -rf /\x00",
+			"0018ERR Invalid command\n",
+		},
+	}
+
+	for _, test := range tests {
+		stdout := &bytes.Buffer{}
+
+		server.serve(request(test.request), stdout, "test")
+
+		if stdout.String() != test.expectedOutput {
+			t.Errorf("expected output %q, got %q (%q)", test.expectedOutput, stdout.String(), test.request)
+		}
+	}
+
+	for _, username := range internalApi.usernames {
+		if username != "" {
+			t.Errorf(`expected repo config to be requested for anonymous user, got "%v"`, username)
+		}
+	}
+
+	if len(internalApi.usernames) != 3 {
+		t.Errorf("expected repo config to be requested 3 times, got %v", len(internalApi.usernames))
+	}
+}
+
+func TestInvalidateOnSignal(t *testing.T) {
+	internalApi := &testInternalApi{repoConfigs: map[string]*api.RepoConfig{"foo/bar.git": &api.RepoConfig{RepositoryId: 123}}}
+	cache := api.NewCachingInternalApi(internalApi, time.Hour, time.Second)
+
+	signals := make(chan os.Signal)
+	go invalidateOnSignal(cache, signals, log.New(ioutil.Discard, "", 0))
+
+	cache.GetRepoConfig("foo/bar.git", "sickill")
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGHUP // returns once the first one is handled
+	cache.GetRepoConfig("foo/bar.git", "sickill")
+
+	if len(internalApi.usernames) != 2 {
+		t.Errorf("expected config to be fetched again after signal, got %v calls", len(internalApi.usernames))
+	}
+}
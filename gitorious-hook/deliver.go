@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultMinBackoff   = time.Second
+	defaultMaxBackoff   = 5 * time.Minute
+)
+
+// deliveryWorker delivers events left in the spool by post-receive hooks
+// (because the internal API was unavailable at the time of push), retrying
+// with exponential backoff until they're accepted.
+type deliveryWorker struct {
+	spool      *spool
+	hooksApi   api.HooksApi
+	logger     common.Logger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// deliverPending delivers spooled events in the order of pushes. It stops at
+// the first event that can't be delivered at the moment, so the following
+// ones don't overtake it.
+func (w *deliveryWorker) deliverPending() error {
+	paths, err := w.spool.pending()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		delivered, err := w.spool.deliver(path, w.hooksApi)
+
+		if err != nil {
+			if _, ok := err.(*invalidEventError); ok {
+				w.logger.Printf("event %v rejected: %v, moved to failed events", path, err)
+				continue
+			}
+
+			return err
+		}
+
+		if delivered {
+			w.logger.Printf("event %v delivered", path)
+		}
+	}
+
+	return nil
+}
+
+func nextBackoff(current, min, max time.Duration) time.Duration {
+	if current < min {
+		return min
+	}
+
+	if current*2 > max {
+		return max
+	}
+
+	return current * 2
+}
+
+func (w *deliveryWorker) run(pollInterval time.Duration) {
+	var backoff time.Duration
+
+	for {
+		wait := pollInterval
+
+		if err := w.deliverPending(); err != nil {
+			backoff = nextBackoff(backoff, w.minBackoff, w.maxBackoff)
+			wait = backoff
+			w.logger.Printf("%v, retrying in %v...", err, wait)
+		} else {
+			backoff = 0
+		}
+
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+func spoolEvents(s *spool, usernames ...string) {
+	for i, username := range usernames {
+		id, _ := newEventId(time.Unix(1400000000, int64(i)))
+		s.add(&api.PushEvent{Id: id, Username: username})
+	}
+}
+
+func newTestWorker(s *spool, hooksApi api.HooksApi) *deliveryWorker {
+	return &deliveryWorker{s, hooksApi, log.New(ioutil.Discard, "", 0), time.Second, time.Minute}
+}
+
+func TestDeliveryWorker_DeliverPending(t *testing.T) {
+	s := newTestSpool()
+	defer os.RemoveAll(s.dir)
+
+	spoolEvents(s, "a", "b", "c")
+
+	hooksApi := &testHooksApi{notifyErrs: []error{nil, &api.UnavailableError{Err: api.ErrCircuitOpen}}}
+	worker := newTestWorker(s, hooksApi)
+
+	if err := worker.deliverPending(); err == nil {
+		t.Errorf("expected error when API is unavailable")
+	}
+
+	if len(hooksApi.events) != 1 || hooksApi.events[0].Username != "a" {
+		t.Errorf("expected delivery to stop at the first failure, got %+v", hooksApi.events)
+	}
+
+	if err := worker.deliverPending(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if len(hooksApi.events) != 3 || hooksApi.events[1].Username != "b" || hooksApi.events[2].Username != "c" {
+		t.Errorf("expected remaining events to be delivered in order, got %+v", hooksApi.events)
+	}
+
+	if paths, _ := s.pending(); len(paths) != 0 {
+		t.Errorf("expected empty spool, got %v", paths)
+	}
+}
+
+func TestDeliveryWorker_DeliverPending_Rejected(t *testing.T) {
+	s := newTestSpool()
+	defer os.RemoveAll(s.dir)
+
+	spoolEvents(s, "a", "b")
+
+	hooksApi := &testHooksApi{notifyErrs: []error{&api.HttpError{StatusCode: 422}}}
+	worker := newTestWorker(s, hooksApi)
+
+	if err := worker.deliverPending(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if len(hooksApi.events) != 1 || hooksApi.events[0].Username != "b" {
+		t.Errorf("expected rejected event not to hold up the following ones, got %+v", hooksApi.events)
+	}
+
+	if failed, _ := filepath.Glob(filepath.Join(s.dir, "failed", "*.json")); len(failed) != 1 {
+		t.Errorf("expected rejected event to be moved to failed events, got %v", failed)
+	}
+}
+
+func TestIsPermanentFailure(t *testing.T) {
+	var tests = []struct {
+		err      error
+		expected bool
+	}{
+		{&api.HttpError{StatusCode: 422}, true},
+		{&api.HttpError{StatusCode: 400}, false}, // invalid signature
+		{&api.HttpError{StatusCode: 401}, false},
+		{&api.HttpError{StatusCode: 403}, false},
+		{&api.HttpError{StatusCode: 404}, false},
+		{&api.HttpError{StatusCode: 500}, false},
+		{&api.UnavailableError{Err: api.ErrCircuitOpen}, false},
+	}
+
+	for _, test := range tests {
+		if actual := isPermanentFailure(test.err); actual != test.expected {
+			t.Errorf("expected %v, got %v (%v)", test.expected, actual, test)
+		}
+	}
+}
+
+func TestSpool_Deliver_Locked(t *testing.T) {
+	s := newTestSpool()
+	defer os.RemoveAll(s.dir)
+
+	spoolEvents(s, "a")
+	paths, _ := s.pending()
+
+	f, _ := os.Open(paths[0])
+	defer f.Close()
+	syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+
+	hooksApi := &testHooksApi{}
+
+	if delivered, err := s.deliver(paths[0], hooksApi); delivered || err != nil {
+		t.Errorf("expected event locked by other process to be skipped, got %v, %v", delivered, err)
+	}
+
+	if len(hooksApi.events) != 0 {
+		t.Errorf("expected no events to be sent, got %+v", hooksApi.events)
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	var tests = []struct {
+		current  time.Duration
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{time.Second, 2 * time.Second},
+		{40 * time.Second, time.Minute},
+		{time.Minute, time.Minute},
+	}
+
+	for _, test := range tests {
+		actual := nextBackoff(test.current, time.Second, time.Minute)
+
+		if actual != test.expected {
+			t.Errorf("expected %v, got %v (%v)", test.expected, actual, test)
+		}
+	}
+}
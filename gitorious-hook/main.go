@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+func say(w io.Writer, s string, args ...interface{}) {
+	fmt.Fprintf(w, "%v\n", fmt.Sprintf(s, args...))
+}
+
+// hookContext holds information about the push, passed to hooks in env
+// variables by gitorious-shell and gitorious-http-backend (see
+// common.CreateEnv).
+type hookContext struct {
+	proto          string
+	username       string
+	repositoryId   int
+	customHookPath string
+}
+
+// isLocalPush tells whether the push comes from the app itself (merge request
+// update from UI etc).
+func (c *hookContext) isLocalPush() bool {
+	return c.proto == ""
+}
+
+func getHookContext(customHookVar string) *hookContext {
+	repositoryId, _ := strconv.Atoi(os.Getenv("GITORIOUS_REPOSITORY_ID"))
+
+	return &hookContext{
+		proto:          os.Getenv("GITORIOUS_PROTO"),
+		username:       os.Getenv("GITORIOUS_USER"),
+		repositoryId:   repositoryId,
+		customHookPath: os.Getenv(customHookVar),
+	}
+}
+
+func sayApiError(stderr io.Writer, err error) {
+	switch err.(type) {
+	case *api.UnavailableError:
+		say(stderr, "Service temporarily unavailable, please try again later")
+	default:
+		say(stderr, "Error occured, please contact support")
+	}
+}
+
+// runCustomHook runs the custom hook (if any) with the given input and returns
+// its exit status.
+func runCustomHook(path string, args []string, input []byte, stdout, stderr io.Writer) int {
+	if path == "" {
+		return 0
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return status.ExitStatus()
+			}
+		}
+
+		say(stderr, "Error occured in custom hook: %v", err)
+		return 1
+	}
+
+	return 0
+}
+
+func newInternalApi() (*api.GitoriousInternalApi, error) {
+	internalApi, err := common.NewInternalApiFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// used by the former bash hooks
+	if apiUrl := os.Getenv("INTERNAL_API_URL"); apiUrl != "" && os.Getenv("GITORIOUS_INTERNAL_API_URL") == "" {
+		internalApi.ApiUrl = apiUrl
+	}
+
+	return internalApi, nil
+}
+
+func getSpool() *spool {
+	return &spool{common.Getenv("GITORIOUS_SPOOL_DIR", defaultSpoolDir)}
+}
+
+func deliver(internalApi *api.GitoriousInternalApi, args []string) {
+	flags := flag.NewFlagSet("deliver", flag.ExitOnError)
+	spoolDir := flags.String("spool-dir", getSpool().dir, "Directory with spooled push events")
+	pollInterval := flags.Duration("poll-interval", defaultPollInterval, "How often to check the spool for new events")
+	minBackoff := flags.Duration("min-backoff", defaultMinBackoff, "Delay before the first retry of a failed delivery")
+	maxBackoff := flags.Duration("max-backoff", defaultMaxBackoff, "Maximum delay between retries of a failed delivery")
+	flags.Parse(args)
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	logger.Printf("delivering events from %v", *spoolDir)
+
+	worker := &deliveryWorker{&spool{*spoolDir}, internalApi, logger, *minBackoff, *maxBackoff}
+	worker.run(*pollInterval)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		say(os.Stderr, "usage: %v pre-receive|post-receive|deliver", os.Args[0])
+		os.Exit(1)
+	}
+
+	internalApi, err := newInternalApi()
+	if err != nil {
+		say(os.Stderr, "Error occured, please contact support")
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "pre-receive":
+		os.Exit(preReceive(internalApi, getHookContext("GITORIOUS_CUSTOM_PRE_RECEIVE_PATH"), os.Stdin, os.Stdout, os.Stderr))
+	case "post-receive":
+		os.Exit(postReceive(internalApi, getSpool(), startDetachedDelivery, getHookContext("GITORIOUS_CUSTOM_POST_RECEIVE_PATH"), os.Stdin, os.Stdout, os.Stderr))
+	case "deliver-event":
+		if len(os.Args) < 3 {
+			say(os.Stderr, "usage: %v deliver-event <path>", os.Args[0])
+			os.Exit(1)
+		}
+
+		// started by post-receive, on failure the worker will take care of it
+		path := os.Args[2]
+		(&spool{filepath.Dir(path)}).deliver(path, internalApi)
+	case "deliver":
+		deliver(internalApi, os.Args[2:])
+	default:
+		say(os.Stderr, "unknown hook %v", os.Args[1])
+		os.Exit(1)
+	}
+}
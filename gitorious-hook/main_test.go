@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNewInternalApi(t *testing.T) {
+	var tests = []struct {
+		apiUrl         string
+		legacyApiUrl   string
+		expectedApiUrl string
+	}{
+		{"", "", "http://localhost:3000/api/internal"},
+		{"unix:///var/run/gitorious/api.sock", "", "unix:///var/run/gitorious/api.sock"},
+		{"", "http://gitorious:3000/api/internal", "http://gitorious:3000/api/internal"},
+		// exported by gitorious-http-backend, taking precedence
+		{"unix:///var/run/gitorious/api.sock", "http://gitorious:3000/api/internal", "unix:///var/run/gitorious/api.sock"},
+	}
+
+	defer os.Unsetenv("GITORIOUS_INTERNAL_API_URL")
+	defer os.Unsetenv("INTERNAL_API_URL")
+
+	for _, test := range tests {
+		os.Setenv("GITORIOUS_INTERNAL_API_URL", test.apiUrl)
+		os.Setenv("INTERNAL_API_URL", test.legacyApiUrl)
+
+		internalApi, err := newInternalApi()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if internalApi.ApiUrl != test.expectedApiUrl {
+			t.Errorf("expected API URL %v, got %v (%v)", test.expectedApiUrl, internalApi.ApiUrl, test)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+// startDetachedDelivery delivers the spooled event in a background process
+// (gitorious-hook deliver-event), so the push doesn't wait for the API.
+func startDetachedDelivery(path string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// stdio is /dev/null, so git doesn't wait for the process either
+	cmd := exec.Command(executable, "deliver-event", path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	return cmd.Process.Release()
+}
+
+// postReceive stores the push event in the spool and starts its delivery with
+// startDelivery without waiting for it, leaving retries to the delivery
+// worker. Then it delegates to the custom post-receive hook (if any). It
+// returns hook's exit status.
+func postReceive(hooksApi api.HooksApi, s *spool, startDelivery func(string) error, ctx *hookContext, stdin io.Reader, stdout, stderr io.Writer) int {
+	if ctx.isLocalPush() {
+		return 0 // skipping custom hook
+	}
+
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		say(stderr, "Error occured, please contact support")
+		return 1
+	}
+
+	refs, err := parseRefUpdates(string(input))
+	if err != nil {
+		say(stderr, "Error occured, please contact support")
+		return 1
+	}
+
+	now := time.Now().UTC()
+
+	id, err := newEventId(now)
+	if err != nil {
+		say(stderr, "Error occured, please contact support")
+		return 1
+	}
+
+	event := &api.PushEvent{
+		Id:           id,
+		Username:     ctx.username,
+		RepositoryId: ctx.repositoryId,
+		PushedAt:     now,
+		Refs:         refs,
+	}
+
+	if path, err := s.add(event); err != nil {
+		// better late than never: without the spool we get a single shot
+		if err := hooksApi.NotifyPush(event); err != nil {
+			say(stderr, "Error occured, please contact support")
+		}
+	} else {
+		startDelivery(path) // on failure the worker will take care of it
+	}
+
+	return runCustomHook(ctx.customHookPath, nil, input, stdout, stderr)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+func newTestSpool() *spool {
+	dir, _ := ioutil.TempDir("", "gitorious-hook")
+	return &spool{dir}
+}
+
+func TestPostReceive(t *testing.T) {
+	s := newTestSpool()
+	defer os.RemoveAll(s.dir)
+
+	hooksApi := &testHooksApi{}
+	ctx := &hookContext{proto: "ssh", username: "sickill", repositoryId: 123}
+
+	var started []string
+	startDelivery := func(path string) error {
+		started = append(started, path)
+		return nil
+	}
+
+	status := postReceive(hooksApi, s, startDelivery, ctx, bytes.NewBufferString(pushInput), &bytes.Buffer{}, &bytes.Buffer{})
+
+	if status != 0 {
+		t.Errorf("expected exit status 0, got %v", status)
+	}
+
+	if len(hooksApi.events) != 0 {
+		t.Errorf("expected hook not to wait for delivery, got %v events", len(hooksApi.events))
+	}
+
+	if paths, _ := s.pending(); len(started) != 1 || len(paths) != 1 || started[0] != paths[0] {
+		t.Fatalf("expected delivery of spooled event to be started, got %v (spooled: %v)", started, paths)
+	}
+
+	// what deliver-event does in the background
+	if delivered, err := s.deliver(started[0], hooksApi); !delivered || err != nil {
+		t.Fatalf("expected event to be delivered, got %v, %v", delivered, err)
+	}
+
+	event := hooksApi.events[0]
+	if event.Id == "" || event.Username != "sickill" || event.RepositoryId != 123 || event.PushedAt.IsZero() || len(event.Refs) != 2 {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	if paths, _ := s.pending(); len(paths) != 0 {
+		t.Errorf("expected delivered event to be removed from the spool, got %v", paths)
+	}
+}
+
+func TestPostReceive_Unavailable(t *testing.T) {
+	s := newTestSpool()
+	defer os.RemoveAll(s.dir)
+
+	hooksApi := &testHooksApi{notifyErrs: []error{&api.UnavailableError{Err: api.ErrCircuitOpen}}}
+	ctx := &hookContext{proto: "http", username: "sickill", repositoryId: 123, customHookPath: customHookPath()}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	startDelivery := func(path string) error {
+		s.deliver(path, hooksApi)
+		return nil
+	}
+
+	status := postReceive(hooksApi, s, startDelivery, ctx, bytes.NewBufferString(pushInput), stdout, stderr)
+
+	if status != 0 {
+		t.Errorf("expected exit status 0, got %v", status)
+	}
+
+	if stdout.String() != "custom hook \n"+pushInput || stderr.String() != "" {
+		t.Errorf("expected custom hook to be run without errors, got stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+
+	paths, _ := s.pending()
+	if len(paths) != 1 {
+		t.Fatalf("expected event to be kept in the spool, got %v", paths)
+	}
+
+	if delivered, err := s.deliver(paths[0], hooksApi); !delivered || err != nil {
+		t.Errorf("expected spooled event to be delivered later, got %v, %v", delivered, err)
+	}
+
+	if len(hooksApi.events) != 1 || hooksApi.events[0].Username != "sickill" || len(hooksApi.events[0].Refs) != 2 {
+		t.Errorf("unexpected events %+v", hooksApi.events)
+	}
+}
+
+func TestPostReceive_LocalPush(t *testing.T) {
+	s := newTestSpool()
+	defer os.RemoveAll(s.dir)
+
+	hooksApi := &testHooksApi{}
+
+	status := postReceive(hooksApi, s, startDetachedDelivery, &hookContext{}, bytes.NewBufferString(pushInput), &bytes.Buffer{}, &bytes.Buffer{})
+
+	if status != 0 || len(hooksApi.events) != 0 {
+		t.Errorf("expected local push to be skipped")
+	}
+}
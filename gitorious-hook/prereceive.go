@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+const zeroSha = "0000000000000000000000000000000000000000"
+
+// parseRefUpdates parses "<oldsha> <newsha> <refname>" lines git passes to
+// pre-receive and post-receive hooks.
+func parseRefUpdates(input string) ([]api.RefUpdate, error) {
+	var refs []api.RefUpdate
+
+	for _, line := range strings.Split(input, "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New(fmt.Sprintf(`invalid ref update line "%v"`, line))
+		}
+
+		refs = append(refs, api.RefUpdate{Refname: fields[2], OldSha: fields[0], NewSha: fields[1]})
+	}
+
+	return refs, nil
+}
+
+func mergeBase(oldSha, newSha string) string {
+	if oldSha == zeroSha || newSha == zeroSha { // ref creation or deletion
+		return ""
+	}
+
+	output, err := exec.Command("git", "merge-base", oldSha, newSha).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// preReceive authorizes all pushed refs with a single internal API call, then
+// delegates to the custom pre-receive hook (if any). It returns hook's exit
+// status.
+func preReceive(hooksApi api.HooksApi, ctx *hookContext, stdin io.Reader, stdout, stderr io.Writer) int {
+	if ctx.isLocalPush() {
+		return 0 // skipping custom hook
+	}
+
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		say(stderr, "Error occured, please contact support")
+		return 1
+	}
+
+	refs, err := parseRefUpdates(string(input))
+	if err != nil {
+		say(stderr, "Error occured, please contact support")
+		return 1
+	}
+
+	for i := range refs {
+		refs[i].MergeBase = mergeBase(refs[i].OldSha, refs[i].NewSha)
+	}
+
+	if err := hooksApi.AuthorizePush(ctx.username, ctx.repositoryId, refs); err != nil {
+		if rejectedErr, ok := err.(*api.PushRejectedError); ok {
+			say(stderr, "%v", strings.TrimRight(rejectedErr.Message, "\n"))
+		} else {
+			sayApiError(stderr, err)
+		}
+
+		return 1
+	}
+
+	return runCustomHook(ctx.customHookPath, nil, input, stdout, stderr)
+}
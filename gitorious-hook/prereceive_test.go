@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+func TestParseRefUpdates(t *testing.T) {
+	input := "b506db4d7520f0257dfe389ab729fa0976ced289 1cbd892e83f597cb6c33a53a45c38a1ba6bbef27 refs/heads/master\n" +
+		"0000000000000000000000000000000000000000 19df9a1b5c973b004f23f7989ce2773ba638acd9 refs/heads/testbranch\n"
+
+	refs, err := parseRefUpdates(input)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := []api.RefUpdate{
+		{Refname: "refs/heads/master", OldSha: "b506db4d7520f0257dfe389ab729fa0976ced289", NewSha: "1cbd892e83f597cb6c33a53a45c38a1ba6bbef27"},
+		{Refname: "refs/heads/testbranch", OldSha: "0000000000000000000000000000000000000000", NewSha: "19df9a1b5c973b004f23f7989ce2773ba638acd9"},
+	}
+
+	if len(refs) != len(expected) || refs[0] != expected[0] || refs[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, refs)
+	}
+
+	if _, err := parseRefUpdates("b506db4d refs/heads/master\n"); err == nil {
+		t.Errorf("expected error for invalid line")
+	}
+}
+
+type testHooksApi struct {
+	username     string
+	repositoryId int
+	refs         []api.RefUpdate
+	err          error
+	events       []*api.PushEvent
+	notifyErrs   []error
+}
+
+func (a *testHooksApi) AuthorizePush(username string, repositoryId int, refs []api.RefUpdate) error {
+	a.username = username
+	a.repositoryId = repositoryId
+	a.refs = refs
+
+	return a.err
+}
+
+func (a *testHooksApi) NotifyPush(event *api.PushEvent) error {
+	var err error
+	if len(a.notifyErrs) > 0 {
+		err, a.notifyErrs = a.notifyErrs[0], a.notifyErrs[1:]
+	}
+
+	if err == nil {
+		a.events = append(a.events, event)
+	}
+
+	return err
+}
+
+const pushInput = "0000000000000000000000000000000000000000 19df9a1b5c973b004f23f7989ce2773ba638acd9 refs/heads/a\n" +
+	"19df9a1b5c973b004f23f7989ce2773ba638acd9 0000000000000000000000000000000000000000 refs/heads/b\n"
+
+func customHookPath() string {
+	cwd, _ := os.Getwd()
+	return filepath.Join(cwd, "fixtures", "custom-hook", "hook")
+}
+
+func TestPreReceive(t *testing.T) {
+	customHookPath := customHookPath()
+
+	var tests = []struct {
+		err              error
+		customHookPath   string
+		customHookStatus string
+		expectedStatus   int
+		expectedStdout   string
+		expectedStderr   string
+	}{
+		{nil, "", "", 0, "", ""},
+		{nil, customHookPath, "0", 0, "custom hook \n" + pushInput, ""},
+		{nil, customHookPath, "3", 3, "custom hook \n" + pushInput, ""},
+		{&api.PushRejectedError{Message: "No pushing to a.\nReally.\n"}, customHookPath, "0", 1, "", "No pushing to a.\nReally.\n"},
+		{&api.UnavailableError{Err: api.ErrCircuitOpen}, "", "", 1, "", "Service temporarily unavailable, please try again later\n"},
+		{&api.HttpError{StatusCode: 500}, "", "", 1, "", "Error occured, please contact support\n"},
+	}
+
+	for _, test := range tests {
+		hooksApi := &testHooksApi{err: test.err}
+		ctx := &hookContext{proto: "ssh", username: "sickill", repositoryId: 123, customHookPath: test.customHookPath}
+		os.Setenv("CUSTOM_HOOK_EXIT_STATUS", test.customHookStatus)
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+
+		status := preReceive(hooksApi, ctx, bytes.NewBufferString(pushInput), stdout, stderr)
+
+		if status != test.expectedStatus {
+			t.Errorf("expected exit status %v, got %v (%v)", test.expectedStatus, status, test)
+		}
+
+		if stdout.String() != test.expectedStdout {
+			t.Errorf("expected stdout %q, got %q (%v)", test.expectedStdout, stdout.String(), test)
+		}
+
+		if stderr.String() != test.expectedStderr {
+			t.Errorf("expected stderr %q, got %q (%v)", test.expectedStderr, stderr.String(), test)
+		}
+
+		if hooksApi.username != "sickill" || hooksApi.repositoryId != 123 || len(hooksApi.refs) != 2 {
+			t.Errorf("expected all refs to be authorized in one call, got %+v", hooksApi)
+		}
+	}
+}
+
+func TestPreReceive_LocalPush(t *testing.T) {
+	hooksApi := &testHooksApi{err: &api.PushRejectedError{Message: "No."}}
+	ctx := &hookContext{proto: ""}
+
+	status := preReceive(hooksApi, ctx, bytes.NewBufferString(pushInput), &bytes.Buffer{}, &bytes.Buffer{})
+
+	if status != 0 || hooksApi.refs != nil {
+		t.Errorf("expected local push to be accepted without authorization")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+const defaultSpoolDir = "/var/spool/gitorious/post-receive"
+
+// spool keeps push events on disk until they're accepted by the internal API.
+// Each event is stored in a separate "<id>.json" file, where id starts with
+// nanosecond timestamp so the events sort in the order they were added. Events
+// rejected by the API for good are moved to "failed" subdirectory.
+type spool struct {
+	dir string
+}
+
+func newEventId(t time.Time) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%019d-%v", t.UnixNano(), hex.EncodeToString(random)), nil
+}
+
+// add durably stores the event, so it survives crashes of both the hook and
+// the host.
+func (s *spool) add(event *api.PushEvent) (string, error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	tmpFile, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(s.dir, event.Id+".json")
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return "", err
+	}
+
+	if err := syncDir(s.dir); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// pending returns paths of all spooled events, oldest first.
+func (s *spool) pending() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// deliver sends the spooled event to the API and removes it once accepted.
+// The event file is locked for the time of delivery so the hook and the
+// delivery worker never send the same event concurrently. It returns false
+// when the event is being delivered by someone else or is already gone.
+// Events the API will never accept are moved out of the way and reported with
+// invalidEventError.
+func (s *spool) deliver(path string, hooksApi api.HooksApi) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	// the file could have been delivered and removed before we locked it
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	var event api.PushEvent
+	if err := json.NewDecoder(f).Decode(&event); err != nil {
+		return true, s.moveToFailed(path, err)
+	}
+
+	if err := hooksApi.NotifyPush(&event); err != nil {
+		if isPermanentFailure(err) {
+			return true, s.moveToFailed(path, err)
+		}
+
+		return true, err
+	}
+
+	return true, os.Remove(path)
+}
+
+// invalidEventError means the event will never be accepted, no matter how many
+// times it's retried.
+type invalidEventError struct {
+	Err error
+}
+
+func (e *invalidEventError) Error() string {
+	return e.Err.Error()
+}
+
+// isPermanentFailure tells whether the API explicitly rejected the event
+// itself with 422 status. Other errors, including 400 for invalid signature
+// (secret mismatch or clock drift), 401, 403 and 404 (app not upgraded yet)
+// are retried, as they're a matter of configuration and events must not be
+// dropped because of them.
+func isPermanentFailure(err error) bool {
+	httpErr, ok := err.(*api.HttpError)
+	return ok && httpErr.StatusCode == 422
+}
+
+// moveToFailed sets the event aside so it doesn't hold up delivery of the
+// following ones.
+func (s *spool) moveToFailed(path string, reason error) error {
+	failedDir := filepath.Join(s.dir, "failed")
+	if err := os.MkdirAll(failedDir, 0700); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, filepath.Join(failedDir, filepath.Base(path))); err != nil {
+		return err
+	}
+
+	return &invalidEventError{reason}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type accessLogFormat string
+
+const (
+	accessLogCombined accessLogFormat = "combined"
+	accessLogJson     accessLogFormat = "json"
+)
+
+func parseAccessLogFormat(s string) (accessLogFormat, error) {
+	switch format := accessLogFormat(s); format {
+	case accessLogCombined, accessLogJson:
+		return format, nil
+	}
+
+	return "", errors.New(fmt.Sprintf(`invalid access log format "%v"`, s))
+}
+
+type accessLogEntry struct {
+	Time         time.Time `json:"time"`
+	RemoteAddr   string    `json:"remote_addr"`
+	User         string    `json:"user"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Protocol     string    `json:"protocol"`
+	Status       int       `json:"status"`
+	BytesOut     int64     `json:"bytes_out"`
+	BytesIn      int64     `json:"bytes_in"`
+	Duration     float64   `json:"duration"` // seconds
+	RepositoryId int       `json:"repository_id,omitempty"`
+	Service      string    `json:"service"`
+	Referer      string    `json:"referer"`
+	UserAgent    string    `json:"user_agent"`
+}
+
+func newAccessLogEntry(s *session, req *http.Request) *accessLogEntry {
+	return &accessLogEntry{
+		Time:         s.start,
+		RemoteAddr:   remoteHost(req.RemoteAddr),
+		User:         s.username,
+		Method:       req.Method,
+		Path:         req.URL.RequestURI(),
+		Protocol:     req.Proto,
+		Status:       s.w.status,
+		BytesOut:     s.w.count,
+		BytesIn:      s.body.Count,
+		Duration:     time.Since(s.start).Seconds(),
+		RepositoryId: s.repositoryId,
+		Service:      s.service,
+		Referer:      req.Referer(),
+		UserAgent:    req.UserAgent(),
+	}
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// combined formats the entry in Combined Log Format, followed by request
+// bytes, duration, repository id and service:
+//
+//	1.2.3.4 - sickill [13/May/2014:16:53:20 +0000] "GET /foo/bar.git/info/refs?service=git-upload-pack HTTP/1.1" 200 1234 "-" "git/2.39.2" 0 0.012 1 info/refs
+func (e *accessLogEntry) combined() string {
+	bytesOut := "-"
+	if e.BytesOut > 0 {
+		bytesOut = strconv.FormatInt(e.BytesOut, 10)
+	}
+
+	repositoryId := "-"
+	if e.RepositoryId != 0 {
+		repositoryId = strconv.Itoa(e.RepositoryId)
+	}
+
+	return fmt.Sprintf(`%v - %v [%v] %v %v %v %v %v %v %.3f %v %v`,
+		e.RemoteAddr,
+		dashIfEmpty(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Protocol),
+		e.Status,
+		bytesOut,
+		strconv.Quote(dashIfEmpty(e.Referer)),
+		strconv.Quote(dashIfEmpty(e.UserAgent)),
+		e.BytesIn,
+		e.Duration,
+		repositoryId,
+		e.Service)
+}
+
+// accessLog writes a line per request to a file, which is reopened on
+// SIGUSR1, after logrotate moved it away.
+type accessLog struct {
+	path   string
+	format accessLogFormat
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func openAccessLog(path string, format accessLogFormat) (*accessLog, error) {
+	l := &accessLog{path: path, format: format}
+
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// reopen opens the file at path again, keeping the current one on failure.
+func (l *accessLog) reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.file = file
+
+	return nil
+}
+
+// write logs the finished request. It's safe to call on nil log (access
+// logging disabled).
+func (l *accessLog) write(s *session, req *http.Request) error {
+	if l == nil {
+		return nil
+	}
+
+	entry := newAccessLogEntry(s, req)
+
+	var line []byte
+
+	if l.format == accessLogJson {
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			return err
+		}
+	} else {
+		line = []byte(entry.combined())
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err := l.file.Write(append(line, '\n'))
+
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+type repositoryIdInternalApi struct {
+	testInternalApi
+}
+
+func (a *repositoryIdInternalApi) GetRepoConfig(repoPath, username string) (*api.RepoConfig, error) {
+	return &api.RepoConfig{RepositoryId: 42, FullPath: "/tmp/missing.git"}, nil
+}
+
+func serveForAccessLog(t *testing.T, format accessLogFormat) string {
+	dir, _ := ioutil.TempDir("", "accesslog")
+	defer os.RemoveAll(dir)
+
+	accessLog, err := openAccessLog(filepath.Join(dir, "access.log"), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: &repositoryIdInternalApi{}, accessLog: accessLog}
+
+	req, _ := http.NewRequest("POST", "http://localhost/foo/bar.git/git-upload-pack?x=1", nil)
+	req.SetBasicAuth("sickill", "xxx")
+	req.RemoteAddr = "1.2.3.4:5678"
+	req.Header.Set("User-Agent", `git/2.39.2 "quoted"`)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	data, _ := ioutil.ReadFile(accessLog.path)
+
+	return string(data)
+}
+
+func TestAccessLog_Combined(t *testing.T) {
+	line := serveForAccessLog(t, accessLogCombined)
+
+	pattern := regexp.MustCompile(`^1\.2\.3\.4 - sickill:xxx \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "POST /foo/bar.git/git-upload-pack\?x=1 HTTP/1.1" 500 \d+ "-" "git/2.39.2 \\"quoted\\"" \d+ \d+\.\d{3} 42 upload-pack\n$`)
+
+	if !pattern.MatchString(line) {
+		t.Errorf("expected combined log line, got %q", line)
+	}
+}
+
+func TestAccessLog_Json(t *testing.T) {
+	line := serveForAccessLog(t, accessLogJson)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("expected JSON object, got %q (%v)", line, err)
+	}
+
+	expected := map[string]interface{}{
+		"remote_addr":   "1.2.3.4",
+		"user":          "sickill:xxx",
+		"method":        "POST",
+		"path":          "/foo/bar.git/git-upload-pack?x=1",
+		"protocol":      "HTTP/1.1",
+		"status":        float64(500),
+		"repository_id": float64(42),
+		"service":       "upload-pack",
+		"user_agent":    `git/2.39.2 "quoted"`,
+	}
+
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("expected %v to be %v, got %v", key, value, entry[key])
+		}
+	}
+
+	for _, key := range []string{"time", "bytes_out", "bytes_in", "duration"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("expected %v in %q", key, line)
+		}
+	}
+}
+
+func TestAccessLog_Reopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "accesslog")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+
+	accessLog, err := openAccessLog(path, accessLogCombined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newServer(log.New(ioutil.Discard, "", 0), 0)
+	server.accessLog = accessLog
+
+	s := newSession(nil, nil, nil, httptest.NewRecorder(), httptest.NewRequest("GET", "/first", nil))
+	accessLog.write(s, s.req)
+
+	// logrotate
+	os.Rename(path, path+".1")
+	server.reopenAccessLog()
+
+	s = newSession(nil, nil, nil, httptest.NewRecorder(), httptest.NewRequest("GET", "/second", nil))
+	accessLog.write(s, s.req)
+
+	rotated, _ := ioutil.ReadFile(path + ".1")
+	current, _ := ioutil.ReadFile(path)
+
+	if !strings.Contains(string(rotated), "/first") || strings.Contains(string(rotated), "/second") {
+		t.Errorf("expected only first request in rotated log, got %q", rotated)
+	}
+
+	if !strings.Contains(string(current), "/second") || strings.Contains(string(current), "/first") {
+		t.Errorf("expected only second request in reopened log, got %q", current)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+type authCacheEntry struct {
+	user        *api.User
+	accessToken *api.AccessToken
+	expiresAt   time.Time
+}
+
+// authCache remembers successful authentications for a short time, so a
+// clone (which takes several requests) doesn't make Gitorious hash the
+// password over and over. Credentials are only kept as HMAC with a random key
+// generated on start, so they can't be recovered from memory.
+type authCache struct {
+	ttl time.Duration
+	key []byte
+	now func() time.Time
+
+	mutex     sync.Mutex
+	entries   map[[sha256.Size]byte]*authCacheEntry
+	lastSweep time.Time
+}
+
+func newAuthCache(ttl time.Duration) (*authCache, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &authCache{
+		ttl:     ttl,
+		key:     key,
+		now:     time.Now,
+		entries: make(map[[sha256.Size]byte]*authCacheEntry),
+	}, nil
+}
+
+func (c *authCache) mac(credentials []string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, c.key)
+
+	// length prefixed, so ("ab", "c") and ("a", "bc") don't collide
+	for _, credential := range credentials {
+		fmt.Fprintf(mac, "%d:%s", len(credential), credential)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], mac.Sum(nil))
+
+	return sum
+}
+
+// get returns the cached authentication for the given credentials, or nil.
+// It's safe to call on nil cache (caching disabled).
+func (c *authCache) get(credentials ...string) *authCacheEntry {
+	if c == nil {
+		return nil
+	}
+
+	key := c.mac(credentials)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	return entry
+}
+
+func (c *authCache) set(entry *authCacheEntry, credentials ...string) {
+	if c == nil {
+		return
+	}
+
+	key := c.mac(credentials)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	entry.expiresAt = now.Add(c.ttl)
+	c.entries[key] = entry
+
+	// drop expired entries from time to time so the cache doesn't grow forever
+	if now.Sub(c.lastSweep) > c.ttl {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+
+		c.lastSweep = now
+	}
+}
+
+type authFailures struct {
+	count       int
+	since       time.Time
+	lockedUntil time.Time
+}
+
+// lockoutKey identifies failures of a username from an IP, or of all
+// usernames from an IP when username is empty.
+type lockoutKey struct {
+	username string
+	ip       string
+}
+
+// authLockout counts failed authentication attempts per username and client
+// IP pair, and per client IP. After maxFailures for the pair (or
+// maxIpFailures for the IP) within duration further attempts are rejected for
+// duration, without asking Gitorious.
+//
+// Usernames are never locked out globally, so nobody can lock a user out by
+// guessing their password from elsewhere. The price is that an attacker with
+// many IPs can make maxFailures guesses per IP.
+type authLockout struct {
+	maxFailures   int
+	maxIpFailures int // IPs are never locked out when 0
+	duration      time.Duration
+	now           func() time.Time
+
+	mutex     sync.Mutex
+	failures  map[lockoutKey]*authFailures
+	lastSweep time.Time
+}
+
+func newAuthLockout(maxFailures, maxIpFailures int, duration time.Duration) *authLockout {
+	return &authLockout{
+		maxFailures:   maxFailures,
+		maxIpFailures: maxIpFailures,
+		duration:      duration,
+		now:           time.Now,
+		failures:      make(map[lockoutKey]*authFailures),
+	}
+}
+
+// limits returns keys the attempt counts against, with their limits.
+func (l *authLockout) limits(username, ip string) map[lockoutKey]int {
+	limits := make(map[lockoutKey]int)
+
+	if username != "" {
+		limits[lockoutKey{username, ip}] = l.maxFailures
+	}
+
+	if ip != "" && l.maxIpFailures > 0 {
+		limits[lockoutKey{"", ip}] = l.maxIpFailures
+	}
+
+	return limits
+}
+
+// locked tells whether the username is locked out for the IP, or the IP is
+// locked out altogether, and for how long. It's safe to call on nil lockout
+// (lockout disabled), like the other methods.
+func (l *authLockout) locked(username, ip string) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	var retryAfter time.Duration
+
+	for key := range l.limits(username, ip) {
+		if failures, ok := l.failures[key]; ok && now.Before(failures.lockedUntil) {
+			if d := failures.lockedUntil.Sub(now); d > retryAfter {
+				retryAfter = d
+			}
+		}
+	}
+
+	return retryAfter, retryAfter > 0
+}
+
+func (l *authLockout) fail(username, ip string) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+
+	for key, maxFailures := range l.limits(username, ip) {
+		failures, ok := l.failures[key]
+		if !ok || now.Sub(failures.since) > l.duration {
+			failures = &authFailures{since: now}
+			l.failures[key] = failures
+		}
+
+		failures.count++
+		if failures.count >= maxFailures {
+			failures.lockedUntil = now.Add(l.duration)
+		}
+	}
+
+	// drop stale counters from time to time so the map doesn't grow forever
+	if now.Sub(l.lastSweep) > l.duration {
+		for key, failures := range l.failures {
+			if now.Sub(failures.since) > l.duration && !now.Before(failures.lockedUntil) {
+				delete(l.failures, key)
+			}
+		}
+
+		l.lastSweep = now
+	}
+}
+
+// succeed forgets failed attempts of the (authenticated) username from the
+// IP. Failures of the IP as a whole are kept, so an attacker with a valid
+// account can't use it to reset them.
+func (l *authLockout) succeed(username, ip string) {
+	if l == nil || username == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.failures, lockoutKey{username, ip})
+}
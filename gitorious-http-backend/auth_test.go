@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+func TestAuthCache(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+
+	cache, err := newAuthCache(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.now = func() time.Time { return now }
+
+	cache.set(&authCacheEntry{user: &api.User{Username: "sickill"}}, "basic", "sickill", "secret")
+
+	if entry := cache.get("basic", "sickill", "secret"); entry == nil || entry.user.Username != "sickill" {
+		t.Errorf("expected cached user sickill, got %v", entry)
+	}
+
+	var misses = [][]string{
+		{"basic", "sickill", "wrong"},
+		{"basic", "sickil", "lsecret"},
+		{"bearer", "secret"},
+	}
+
+	for _, credentials := range misses {
+		if entry := cache.get(credentials...); entry != nil {
+			t.Errorf("expected no entry, got %v (%v)", entry, credentials)
+		}
+	}
+
+	now = now.Add(time.Minute)
+
+	if entry := cache.get("basic", "sickill", "secret"); entry != nil {
+		t.Errorf("expected entry to expire, got %v", entry)
+	}
+
+	var nilCache *authCache
+	nilCache.set(&authCacheEntry{}, "bearer", "secret")
+	if entry := nilCache.get("bearer", "secret"); entry != nil {
+		t.Errorf("expected nil cache to cache nothing, got %v", entry)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+
+	lockout := newAuthLockout(3, 5, time.Minute)
+	lockout.now = func() time.Time { return now }
+
+	lockout.fail("sickill", "1.2.3.4")
+	lockout.fail("sickill", "1.2.3.4")
+	lockout.fail("sickill", "5.6.7.8")
+
+	if _, locked := lockout.locked("sickill", "1.2.3.4"); locked {
+		t.Errorf("expected sickill not to be locked out after 2 failures from 1.2.3.4")
+	}
+
+	lockout.fail("sickill", "1.2.3.4")
+
+	if retryAfter, locked := lockout.locked("sickill", "1.2.3.4"); !locked || retryAfter != time.Minute {
+		t.Errorf("expected sickill to be locked out from 1.2.3.4 for 1m, got %v (locked: %v)", retryAfter, locked)
+	}
+
+	if _, locked := lockout.locked("sickill", "9.9.9.9"); locked {
+		t.Errorf("expected sickill not to be locked out from other IPs")
+	}
+
+	// success forgets failures of the user from the IP only
+	lockout.fail("ajax", "9.9.9.9")
+	lockout.fail("ajax", "9.9.9.9")
+	lockout.succeed("ajax", "9.9.9.9")
+	lockout.fail("ajax", "9.9.9.9")
+
+	if _, locked := lockout.locked("ajax", "9.9.9.9"); locked {
+		t.Errorf("expected failures of ajax to be forgotten after success")
+	}
+
+	// 5th failure from 1.2.3.4 locks it out for everyone
+	lockout.fail("ajax", "1.2.3.4")
+	lockout.fail("", "1.2.3.4")
+
+	if _, locked := lockout.locked("bob", "1.2.3.4"); !locked {
+		t.Errorf("expected 1.2.3.4 to be locked out after 5 failures")
+	}
+
+	now = now.Add(30 * time.Second)
+
+	if retryAfter, locked := lockout.locked("", "1.2.3.4"); !locked || retryAfter != 30*time.Second {
+		t.Errorf("expected 1.2.3.4 to be locked out for 30s, got %v (locked: %v)", retryAfter, locked)
+	}
+
+	now = now.Add(30 * time.Second)
+
+	if _, locked := lockout.locked("sickill", "1.2.3.4"); locked {
+		t.Errorf("expected lockout to expire")
+	}
+
+	// failures older than the lockout duration are not counted
+	lockout.fail("ajax", "")
+	lockout.fail("ajax", "")
+	now = now.Add(2 * time.Minute)
+	lockout.fail("ajax", "")
+
+	if _, locked := lockout.locked("ajax", ""); locked {
+		t.Errorf("expected old failures not to be counted")
+	}
+}
+
+type authCountingInternalApi struct {
+	testInternalApi
+	calls int
+}
+
+func (a *authCountingInternalApi) AuthenticateUser(username, password string) (*api.User, error) {
+	a.calls++
+
+	if password != "secret" {
+		return nil, nil
+	}
+
+	return &api.User{Username: username}, nil
+}
+
+func TestHandler_ServeHTTP_AuthCacheAndLockout(t *testing.T) {
+	internalApi := &authCountingInternalApi{testInternalApi: testInternalApi{
+		Err:          &api.HttpError{StatusCode: 404},
+		AccessTokens: map[string]*api.AccessToken{"t0ken": {Username: "mallory", Scopes: []api.TokenScope{api.ScopeRead}}},
+	}}
+	cache, _ := newAuthCache(time.Minute)
+
+	handler := &Handler{
+		logger:      log.New(ioutil.Discard, "", 0),
+		internalApi: internalApi,
+		authCache:   cache,
+		authLockout: newAuthLockout(3, 4, time.Minute),
+	}
+
+	var tests = []struct {
+		username           string
+		password           string
+		ip                 string
+		expectedStatus     int
+		expectedCalls      int
+		expectedRetryAfter string
+	}{
+		{"sickill", "secret", "1.2.3.4", 404, 1, ""},
+		{"sickill", "secret", "1.2.3.4", 404, 1, ""}, // cached
+		{"ajax", "wrong1", "1.2.3.4", 401, 2, ""},
+		{"ajax", "wrong2", "1.2.3.4", 401, 3, ""},
+		{"ajax", "wrong3", "1.2.3.4", 401, 4, ""},
+		{"ajax", "secret", "1.2.3.4", 429, 4, "60"},    // user locked out from this IP
+		{"ajax", "secret", "9.9.9.9", 404, 5, ""},      // but not from others
+		{"sickill", "wrong", "1.2.3.4", 401, 6, ""},    // 4th failure from this IP
+		{"sickill", "secret", "1.2.3.4", 429, 6, "60"}, // IP locked out
+		{"sickill", "secret", "9.9.9.9", 404, 6, ""},
+		// someone else's token doesn't clear failures of the Basic username
+		{"ajax", "wrong1", "5.6.7.8", 401, 7, ""},
+		{"ajax", "wrong2", "5.6.7.8", 401, 8, ""},
+		{"ajax", "t0ken", "5.6.7.8", 404, 9, ""},
+		{"ajax", "wrong3", "5.6.7.8", 401, 10, ""},
+		{"ajax", "secret", "5.6.7.8", 429, 10, "60"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+		req.SetBasicAuth(test.username, test.password)
+		req.RemoteAddr = test.ip + ":5678"
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+
+		if internalApi.calls != test.expectedCalls {
+			t.Errorf("expected %v AuthenticateUser calls, got %v (%v)", test.expectedCalls, internalApi.calls, test)
+		}
+
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != test.expectedRetryAfter {
+			t.Errorf("expected Retry-After %q, got %q (%v)", test.expectedRetryAfter, retryAfter, test)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+var gitServices = map[string]string{
+	"git-upload-pack":  "upload-pack",
+	"git-receive-pack": "receive-pack",
+}
+
+// files served as-is for clients using "dumb" HTTP protocol
+var dumbPathRegexp = regexp.MustCompile("^/(HEAD|info/refs|objects/info/(alternates|http-alternates|packs)|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\\.(pack|idx))$")
+
+func gitServiceName(slug string, req *http.Request) string {
+	if slug == "/info/refs" {
+		return req.URL.Query().Get("service")
+	}
+
+	return strings.TrimPrefix(slug, "/")
+}
+
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+func setCacheForeverHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+}
+
+func execGitService(service string, args []string, env []string, stdin io.Reader, stdout io.Writer) (string, error) {
+	cmd := exec.Command("git", append([]string{service}, args...)...)
+	cmd.Env = env
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+
+	atomic.AddInt64(&gitProcessesInFlight, 1)
+	defer atomic.AddInt64(&gitProcessesInFlight, -1)
+
+	if err := cmd.Run(); err != nil {
+		return strings.Trim(stderrBuf.String(), " \n"), err
+	}
+
+	return "", nil
+}
+
+// serveGit handles both "smart" (by streaming to git upload-pack/receive-pack
+// in stateless RPC mode) and "dumb" HTTP protocol requests.
+func serveGit(env []string, fullRepoPath, slug string, w http.ResponseWriter, req *http.Request) error {
+	switch {
+	case slug == "/info/refs" && req.URL.Query().Get("service") != "":
+		return serveInfoRefs(env, fullRepoPath, w, req)
+	case slug == "/git-upload-pack" || slug == "/git-receive-pack":
+		return serveRpc(env, fullRepoPath, slug[1:], w, req)
+	case dumbPathRegexp.MatchString(slug):
+		return serveFile(fullRepoPath+slug, slug, w, req)
+	}
+
+	say(w, http.StatusNotFound, "Not found")
+	return errors.New(fmt.Sprintf(`unsupported request "%v"`, slug))
+}
+
+func serveInfoRefs(env []string, fullRepoPath string, w http.ResponseWriter, req *http.Request) error {
+	serviceName := req.URL.Query().Get("service")
+
+	service, ok := gitServices[serviceName]
+	if !ok {
+		say(w, http.StatusForbidden, "Unsupported service")
+		return errors.New(fmt.Sprintf(`unsupported service "%v"`, serviceName))
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		say(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return errors.New(fmt.Sprintf("method %v not allowed for info/refs", req.Method))
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%v-advertisement", serviceName))
+	w.WriteHeader(http.StatusOK)
+
+	// protocol v2 capability advertisement is sent without the header, like
+	// git-http-backend does
+	if common.GitProtocolVersion(req.Header.Get("Git-Protocol")) != 2 {
+		common.WritePacket(w, fmt.Sprintf("# service=%v\n", serviceName))
+		common.WriteFlushPacket(w)
+	}
+
+	if stderr, err := execGitService(service, []string{"--stateless-rpc", "--advertise-refs", fullRepoPath}, env, nil, w); err != nil {
+		return errors.New(fmt.Sprintf("error occured in git %v: %v, stderr: %v", service, err, stderr))
+	}
+
+	return nil
+}
+
+func serveRpc(env []string, fullRepoPath, serviceName string, w http.ResponseWriter, req *http.Request) error {
+	service := gitServices[serviceName]
+
+	if req.Method != "POST" {
+		say(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return errors.New(fmt.Sprintf("method %v not allowed for %v", req.Method, serviceName))
+	}
+
+	if req.Header.Get("Content-Type") != fmt.Sprintf("application/x-%v-request", serviceName) {
+		say(w, http.StatusUnsupportedMediaType, "Unsupported content type")
+		return errors.New(fmt.Sprintf(`unsupported content type "%v"`, req.Header.Get("Content-Type")))
+	}
+
+	var body io.Reader = req.Body
+
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			say(w, http.StatusBadRequest, "Invalid request body")
+			return err
+		}
+		defer gzipReader.Close()
+
+		body = gzipReader
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%v-result", serviceName))
+	w.WriteHeader(http.StatusOK)
+
+	if stderr, err := execGitService(service, []string{"--stateless-rpc", fullRepoPath}, env, body, w); err != nil {
+		return errors.New(fmt.Sprintf("error occured in git %v: %v, stderr: %v", service, err, stderr))
+	}
+
+	return nil
+}
+
+func serveFile(path, slug string, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		say(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return errors.New(fmt.Sprintf("method %v not allowed for %v", req.Method, slug))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		say(w, http.StatusNotFound, "Not found")
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		say(w, http.StatusNotFound, "Not found")
+		return errors.New(fmt.Sprintf(`"%v" is not a regular file`, path))
+	}
+
+	switch {
+	case strings.HasPrefix(slug, "/objects/pack/") && strings.HasSuffix(slug, ".pack"):
+		setCacheForeverHeaders(w)
+		w.Header().Set("Content-Type", "application/x-git-packed-objects")
+	case strings.HasPrefix(slug, "/objects/pack/"):
+		setCacheForeverHeaders(w)
+		w.Header().Set("Content-Type", "application/x-git-packed-objects-toc")
+	case strings.HasPrefix(slug, "/objects/info/"):
+		setNoCacheHeaders(w)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case strings.HasPrefix(slug, "/objects/"):
+		setCacheForeverHeaders(w)
+		w.Header().Set("Content-Type", "application/x-git-loose-object")
+	default:
+		setNoCacheHeaders(w)
+		w.Header().Set("Content-Type", "text/plain")
+	}
+
+	http.ServeContent(w, req, "", info.ModTime(), file)
+
+	return nil
+}
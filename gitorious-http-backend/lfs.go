@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+// requests bigger than that are not batch requests git-lfs would send
+const maxLfsBatchRequestSize = 10 * 1024 * 1024
+
+// validity of LFS tokens issued in batch actions to Basic-authenticated users
+const lfsActionTokenTtl = 5 * time.Minute
+
+var lfsObjectPathRegexp = regexp.MustCompile("^/info/lfs/objects/([0-9a-f]{64})$")
+var lfsOidRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type lfsObject struct {
+	Oid     string                `json:"oid"`
+	Size    int64                 `json:"size"`
+	Actions map[string]*lfsAction `json:"actions,omitempty"`
+	Error   *lfsObjectError       `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []*lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string       `json:"transfer"`
+	Objects  []*lfsObject `json:"objects"`
+}
+
+func isLfsRequest(slug string) bool {
+	return strings.HasPrefix(slug, "/info/lfs/")
+}
+
+// readLfsBatchRequest decodes the batch request, leaving req.Body intact so it
+// can be read again.
+func readLfsBatchRequest(req *http.Request) (*lfsBatchRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxLfsBatchRequestSize))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var batch lfsBatchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+
+	if batch.Operation != "upload" && batch.Operation != "download" {
+		return nil, errors.New(fmt.Sprintf(`invalid LFS operation "%v"`, batch.Operation))
+	}
+
+	return &batch, nil
+}
+
+// isLfsUpload tells whether the request stores LFS objects (and thus requires
+// write access to the repository).
+func isLfsUpload(slug string, req *http.Request) bool {
+	if !isLfsRequest(slug) {
+		return false
+	}
+
+	if slug == "/info/lfs/objects/batch" && req.Method == "POST" {
+		batch, err := readLfsBatchRequest(req)
+		return err == nil && batch.Operation == "upload"
+	}
+
+	return req.Method == "PUT"
+}
+
+// lfsTokenAuth returns the token provided in the request's Authorization
+// header, if the request uses LFS token authentication (see common.LfsToken).
+func lfsTokenAuth(req *http.Request) (string, bool) {
+	prefix := common.LfsTokenScheme + " "
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(auth, prefix), true
+}
+
+func lfsOperation(isUpload bool) string {
+	if isUpload {
+		return "upload"
+	}
+
+	return "download"
+}
+
+// lfsActionHeader returns the header to be sent with object requests of batch
+// actions, along with its validity in seconds (0 when unknown). LFS and Bearer
+// tokens are passed on as they are, but Basic credentials never end up in
+// responses, where clients may log or cache them - a short-lived LFS token is
+// issued instead. Without a key to sign it no header is returned, and clients
+// use their own credentials for object requests.
+func lfsActionHeader(key []byte, username, repoPath, operation string, req *http.Request, now time.Time) (map[string]string, int, error) {
+	_, isLfsToken := lfsTokenAuth(req)
+	_, isBearer := bearerAuth(req)
+	if isLfsToken || isBearer {
+		return map[string]string{"Authorization": req.Header.Get("Authorization")}, 0, nil
+	}
+
+	if _, _, ok := BasicAuth(req); !ok || key == nil {
+		return nil, 0, nil
+	}
+
+	token := &common.LfsToken{Username: username, RepoPath: repoPath, Operation: operation, ExpiresAt: now.Add(lfsActionTokenTtl).Unix()}
+	signedToken, err := token.Sign(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return map[string]string{"Authorization": common.LfsTokenScheme + " " + signedToken}, int(lfsActionTokenTtl / time.Second), nil
+}
+
+func sayLfs(w http.ResponseWriter, status int, s string, args ...interface{}) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf(s, args...)})
+}
+
+// lfsStore keeps LFS objects of a single repository in a content-addressed
+// layout (the same one git-lfs uses locally): objects/<oid[0:2]>/<oid[2:4]>/<oid>.
+type lfsStore struct {
+	dir           string
+	maxObjectSize int64 // no limit when 0
+}
+
+func newLfsStore(fullRepoPath string, maxObjectSize int64) *lfsStore {
+	return &lfsStore{filepath.Join(fullRepoPath, "lfs", "objects"), maxObjectSize}
+}
+
+func (s *lfsStore) tooLarge(size int64) bool {
+	return s.maxObjectSize > 0 && size > s.maxObjectSize
+}
+
+func (s *lfsStore) path(oid string) string {
+	return filepath.Join(s.dir, oid[0:2], oid[2:4], oid)
+}
+
+func (s *lfsStore) exists(oid string, size int64) bool {
+	info, err := os.Stat(s.path(oid))
+	return err == nil && info.Size() == size
+}
+
+// put stores the object read from r, making sure its content matches the oid.
+func (s *lfsStore) put(oid string, r io.Reader) error {
+	path := s.path(oid)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != oid {
+		return &lfsOidMismatchError{oid, actual}
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+type lfsOidMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *lfsOidMismatchError) Error() string {
+	return fmt.Sprintf("object content doesn't match oid %v (got %v)", e.Expected, e.Actual)
+}
+
+// lfsObjectUrl returns URL of the object endpoint, on the same host the batch
+// request was made to.
+func lfsObjectUrl(repoPath, oid string, req *http.Request) string {
+	return fmt.Sprintf("%v://%v/%v/info/lfs/objects/%v", requestScheme(req), req.Host, repoPath, oid)
+}
+
+// serveLfs handles Git LFS batch API requests, as well as uploads and downloads
+// of objects with "basic" transfer adapter (see
+// https://github.com/git-lfs/git-lfs/blob/master/docs/api/batch.md).
+// Access to the repository is expected to be checked already.
+func serveLfs(store *lfsStore, repoPath, slug string, header map[string]string, expiresIn int, w http.ResponseWriter, req *http.Request) error {
+	if slug == "/info/lfs/objects/batch" {
+		if req.Method != "POST" {
+			sayLfs(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return errors.New(fmt.Sprintf("unsupported LFS batch request method %v", req.Method))
+		}
+
+		return serveLfsBatch(store, repoPath, header, expiresIn, w, req)
+	}
+
+	if matches := lfsObjectPathRegexp.FindStringSubmatch(slug); matches != nil {
+		oid := matches[1]
+
+		switch req.Method {
+		case "GET":
+			return serveLfsDownload(store, oid, w, req)
+		case "PUT":
+			return serveLfsUpload(store, oid, w, req)
+		}
+
+		sayLfs(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return errors.New(fmt.Sprintf("unsupported LFS object request method %v", req.Method))
+	}
+
+	sayLfs(w, http.StatusNotFound, "Not found")
+	return errors.New(fmt.Sprintf(`unsupported LFS request "%v"`, slug))
+}
+
+func serveLfsBatch(store *lfsStore, repoPath string, header map[string]string, expiresIn int, w http.ResponseWriter, req *http.Request) error {
+	batch, err := readLfsBatchRequest(req)
+	if err != nil {
+		sayLfs(w, http.StatusUnprocessableEntity, "Invalid batch request")
+		return err
+	}
+
+	if !supportsBasicTransfer(batch.Transfers) {
+		sayLfs(w, http.StatusUnprocessableEntity, "Only basic transfer adapter is supported")
+		return errors.New(fmt.Sprintf("unsupported LFS transfers %v", batch.Transfers))
+	}
+
+	response := &lfsBatchResponse{Transfer: "basic"}
+
+	for _, object := range batch.Objects {
+		result := &lfsObject{Oid: object.Oid, Size: object.Size}
+		response.Objects = append(response.Objects, result)
+
+		if !lfsOidRegexp.MatchString(object.Oid) || object.Size < 0 {
+			result.Error = &lfsObjectError{http.StatusUnprocessableEntity, "Invalid object"}
+			continue
+		}
+
+		if batch.Operation == "upload" && store.tooLarge(object.Size) {
+			result.Error = &lfsObjectError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Object is larger than %v bytes", store.maxObjectSize)}
+			continue
+		}
+
+		exists := store.exists(object.Oid, object.Size)
+		action := &lfsAction{Href: lfsObjectUrl(repoPath, object.Oid, req), Header: header, ExpiresIn: expiresIn}
+
+		switch {
+		case batch.Operation == "download" && exists:
+			result.Actions = map[string]*lfsAction{"download": action}
+		case batch.Operation == "download":
+			result.Error = &lfsObjectError{http.StatusNotFound, "Object does not exist"}
+		case !exists: // uploading objects we already have is a no-op
+			result.Actions = map[string]*lfsAction{"upload": action}
+		}
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func supportsBasicTransfer(transfers []string) bool {
+	if len(transfers) == 0 { // basic is implied
+		return true
+	}
+
+	for _, transfer := range transfers {
+		if transfer == "basic" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func serveLfsDownload(store *lfsStore, oid string, w http.ResponseWriter, req *http.Request) error {
+	f, err := os.Open(store.path(oid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			sayLfs(w, http.StatusNotFound, "Object does not exist")
+		} else {
+			sayLfs(w, http.StatusInternalServerError, "Error occured, please contact support")
+		}
+
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		sayLfs(w, http.StatusInternalServerError, "Error occured, please contact support")
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", info.ModTime(), f)
+
+	return nil
+}
+
+func serveLfsUpload(store *lfsStore, oid string, w http.ResponseWriter, req *http.Request) error {
+	if store.tooLarge(req.ContentLength) {
+		sayLfs(w, http.StatusRequestEntityTooLarge, "Object is larger than %v bytes", store.maxObjectSize)
+		return errors.New(fmt.Sprintf("LFS object of %v bytes is too large", req.ContentLength))
+	}
+
+	body := req.Body
+	if store.maxObjectSize > 0 {
+		// Content-Length may be missing (chunked encoding) or lie
+		body = http.MaxBytesReader(w, req.Body, store.maxObjectSize)
+	}
+
+	if err := store.put(oid, body); err != nil {
+		if _, ok := err.(*lfsOidMismatchError); ok {
+			sayLfs(w, http.StatusUnprocessableEntity, "Object content doesn't match its oid")
+		} else if _, ok := err.(*http.MaxBytesError); ok {
+			sayLfs(w, http.StatusRequestEntityTooLarge, "Object is larger than %v bytes", store.maxObjectSize)
+		} else {
+			sayLfs(w, http.StatusInternalServerError, "Error occured, please contact support")
+		}
+
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+func oidOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func lfsRequest(handler http.Handler, method, path, body string, authenticate bool) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://localhost"+path, bytes.NewBufferString(body))
+	req.Header.Set("Accept", lfsMediaType)
+	if authenticate {
+		req.SetBasicAuth("sickill", "xxx")
+	}
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func lfsBatch(handler http.Handler, operation string, authenticate bool, objects ...*lfsObject) (*httptest.ResponseRecorder, *lfsBatchResponse) {
+	body, _ := json.Marshal(&lfsBatchRequest{Operation: operation, Transfers: []string{"basic"}, Objects: objects})
+	w := lfsRequest(handler, "POST", "/foo/bar.git/info/lfs/objects/batch", string(body), authenticate)
+
+	var response lfsBatchResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	return w, &response
+}
+
+func TestHandler_ServeHTTP_Lfs(t *testing.T) {
+	fullRepoPath, _ := ioutil.TempDir("", "gitorious-http-backend")
+	defer os.RemoveAll(fullRepoPath)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	handler := &Handler{logger: logger, internalApi: &testInternalApi{FullRepoPath: fullRepoPath, AccessLevel: api.AccessWrite}, lfsTokenKey: []byte("s3cr3t")}
+
+	content := "large binary asset"
+	oid := oidOf(content)
+	object := &lfsObject{Oid: oid, Size: int64(len(content))}
+
+	w, response := lfsBatch(handler, "download", true, object)
+	if w.Code != 200 || w.Header().Get("Content-Type") != lfsMediaType {
+		t.Fatalf("expected status 200 with LFS content type, got %v (%v)", w.Code, w.Header().Get("Content-Type"))
+	}
+	if response.Transfer != "basic" || len(response.Objects) != 1 || response.Objects[0].Error == nil || response.Objects[0].Error.Code != 404 {
+		t.Errorf("expected 404 error for missing object, got %v", w.Body.String())
+	}
+
+	w, response = lfsBatch(handler, "upload", true, object)
+	if w.Code != 200 || len(response.Objects) != 1 || response.Objects[0].Actions["upload"] == nil {
+		t.Fatalf("expected upload action, got %v", w.Body.String())
+	}
+
+	upload := response.Objects[0].Actions["upload"]
+	expectedHref := fmt.Sprintf("http://localhost/foo/bar.git/info/lfs/objects/%v", oid)
+	if upload.Href != expectedHref || !strings.HasPrefix(upload.Header["Authorization"], "RemoteAuth ") || upload.ExpiresIn != 300 {
+		t.Errorf("expected upload to %v with LFS token, got %+v", expectedHref, upload)
+	}
+
+	w = lfsRequest(handler, "PUT", "/foo/bar.git/info/lfs/objects/"+oid, "something else", true)
+	if w.Code != 422 {
+		t.Errorf("expected status 422 for content not matching oid, got %v", w.Code)
+	}
+
+	req, _ := http.NewRequest("PUT", upload.Href, bytes.NewBufferString(content))
+	for name, value := range upload.Header {
+		req.Header.Set(name, value)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("expected status 200 for upload, got %v (%v)", w.Code, w.Body.String())
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%v/lfs/objects/%v/%v/%v", fullRepoPath, oid[0:2], oid[2:4], oid)); err != nil {
+		t.Errorf("expected object to be stored by its oid, got %v", err)
+	}
+
+	_, response = lfsBatch(handler, "upload", true, object)
+	if len(response.Objects) != 1 || response.Objects[0].Actions != nil {
+		t.Errorf("expected no actions for already uploaded object, got %+v", response.Objects[0])
+	}
+
+	_, response = lfsBatch(handler, "download", false, object, &lfsObject{Oid: "../../etc/passwd", Size: 1})
+	if len(response.Objects) != 2 || response.Objects[0].Actions["download"] == nil || response.Objects[1].Error == nil || response.Objects[1].Error.Code != 422 {
+		t.Errorf("expected download action for stored object and error for invalid one, got %+v", response.Objects)
+	}
+
+	w = lfsRequest(handler, "GET", "/foo/bar.git/info/lfs/objects/"+oid, "", false)
+	if w.Code != 200 || w.Body.String() != content {
+		t.Errorf("expected object content, got %v (%v)", w.Code, w.Body.String())
+	}
+}
+
+func TestHandler_ServeHTTP_LfsAccess(t *testing.T) {
+	fullRepoPath, _ := ioutil.TempDir("", "gitorious-http-backend")
+	defer os.RemoveAll(fullRepoPath)
+
+	content := "large binary asset"
+	oid := oidOf(content)
+	object := &lfsObject{Oid: oid, Size: int64(len(content))}
+
+	var tests = []struct {
+		accessLevel    api.AccessLevel
+		authenticate   bool
+		operation      string
+		expectedStatus int
+	}{
+		{api.AccessRead, false, "download", 200},
+		{api.AccessRead, false, "upload", 401},
+		{api.AccessRead, true, "upload", 403},
+		{api.AccessWrite, true, "upload", 200},
+		{api.AccessAdmin, true, "upload", 200},
+		// older Gitorious versions don't report access level
+		{api.AccessUnknown, true, "download", 200},
+		{api.AccessUnknown, true, "upload", 403},
+	}
+
+	for _, test := range tests {
+		handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: &testInternalApi{FullRepoPath: fullRepoPath, AccessLevel: test.accessLevel}}
+
+		w, _ := lfsBatch(handler, test.operation, test.authenticate, object)
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v for batch request, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+
+		if test.operation == "upload" {
+			w = lfsRequest(handler, "PUT", "/foo/bar.git/info/lfs/objects/"+oid, content, test.authenticate)
+			if w.Code != test.expectedStatus {
+				t.Errorf("expected status %v for upload, got %v (%v)", test.expectedStatus, w.Code, test)
+			}
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_LfsToken(t *testing.T) {
+	fullRepoPath, _ := ioutil.TempDir("", "gitorious-http-backend")
+	defer os.RemoveAll(fullRepoPath)
+
+	key := []byte("s3cr3t")
+	content := "large binary asset"
+	oid := oidOf(content)
+	expiresAt := time.Now().Add(time.Minute).Unix()
+
+	var tests = []struct {
+		tokenRepoPath  string
+		tokenOperation string
+		expiresAt      int64
+		key            []byte
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{"foo/bar.git", "upload", expiresAt, key, "PUT", "/foo/bar.git/info/lfs/objects/" + oid, 200},
+		{"foo/bar.git", "upload", expiresAt, key, "GET", "/foo/bar.git/info/lfs/objects/" + oid, 200},
+		{"foo/bar.git", "download", expiresAt, key, "GET", "/foo/bar.git/info/lfs/objects/" + oid, 200},
+		{"foo/bar.git", "download", expiresAt, key, "PUT", "/foo/bar.git/info/lfs/objects/" + oid, 403},
+		{"foo/baz.git", "upload", expiresAt, key, "GET", "/foo/bar.git/info/lfs/objects/" + oid, 403},
+		{"foo/bar.git", "upload", expiresAt, key, "POST", "/foo/bar.git/git-receive-pack", 403},
+		{"foo/bar.git", "upload", time.Now().Unix(), key, "GET", "/foo/bar.git/info/lfs/objects/" + oid, 401},
+		{"foo/bar.git", "upload", expiresAt, nil, "GET", "/foo/bar.git/info/lfs/objects/" + oid, 401},
+	}
+
+	for _, test := range tests {
+		internalApi := &testInternalApi{FullRepoPath: fullRepoPath, AccessLevel: api.AccessWrite}
+		handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: internalApi, lfsTokenKey: test.key}
+
+		lfsToken := &common.LfsToken{Username: "sickill", RepoPath: test.tokenRepoPath, Operation: test.tokenOperation, ExpiresAt: test.expiresAt}
+		token, _ := lfsToken.Sign(key)
+		req, _ := http.NewRequest(test.method, "http://localhost"+test.path, bytes.NewBufferString(content))
+		req.Header.Set("Authorization", "RemoteAuth "+token)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+	}
+}
+
+func TestLfsActionHeader(t *testing.T) {
+	key := []byte("s3cr3t")
+	now := time.Unix(1500000000, 0)
+
+	var tests = []struct {
+		authorization     string
+		key               []byte
+		expectedHeader    string
+		expectedLfsToken  *common.LfsToken
+		expectedExpiresIn int
+	}{
+		{"RemoteAuth abc.123", key, "RemoteAuth abc.123", nil, 0},
+		{"Bearer abc123", key, "Bearer abc123", nil, 0},
+		{"Basic c2lja2lsbDp4eHg=", key, "", &common.LfsToken{Username: "sickill", RepoPath: "foo/bar.git", Operation: "upload", ExpiresAt: 1500000300}, 300},
+		{"Basic c2lja2lsbDp4eHg=", nil, "", nil, 0},
+		{"", key, "", nil, 0},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://localhost/foo/bar.git/info/lfs/objects/batch", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+
+		header, expiresIn, err := lfsActionHeader(test.key, "sickill", "foo/bar.git", "upload", req, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expiresIn != test.expectedExpiresIn {
+			t.Errorf("expected expires_in %v, got %v (%v)", test.expectedExpiresIn, expiresIn, test)
+		}
+
+		authorization := header["Authorization"]
+		if strings.HasPrefix(authorization, "Basic ") {
+			t.Errorf("expected Basic credentials not to be passed on, got %v (%v)", authorization, test)
+		}
+
+		if test.expectedLfsToken == nil {
+			if authorization != test.expectedHeader {
+				t.Errorf("expected header %q, got %q (%v)", test.expectedHeader, authorization, test)
+			}
+			continue
+		}
+
+		req.Header.Set("Authorization", authorization)
+		token, ok := lfsTokenAuth(req)
+		if !ok {
+			t.Errorf("expected LFS token, got %q (%v)", authorization, test)
+			continue
+		}
+
+		lfsToken, err := common.VerifyLfsToken(key, token, now)
+		if err != nil || *lfsToken != *test.expectedLfsToken {
+			t.Errorf("expected LFS token %+v, got %+v (%v, %v)", test.expectedLfsToken, lfsToken, err, test)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_LfsMaxObjectSize(t *testing.T) {
+	fullRepoPath, _ := ioutil.TempDir("", "gitorious-http-backend")
+	defer os.RemoveAll(fullRepoPath)
+
+	handler := &Handler{
+		logger:           log.New(ioutil.Discard, "", 0),
+		internalApi:      &testInternalApi{FullRepoPath: fullRepoPath, AccessLevel: api.AccessWrite},
+		lfsMaxObjectSize: 10,
+	}
+
+	content := "larger than 10 bytes"
+	oid := oidOf(content)
+
+	_, response := lfsBatch(handler, "upload", true, &lfsObject{Oid: oid, Size: int64(len(content))})
+	if len(response.Objects) != 1 || response.Objects[0].Error == nil || response.Objects[0].Error.Code != 413 {
+		t.Errorf("expected 413 error for too large object, got %+v", response.Objects)
+	}
+
+	w := lfsRequest(handler, "PUT", "/foo/bar.git/info/lfs/objects/"+oid, content, true)
+	if w.Code != 413 {
+		t.Errorf("expected status 413 for too large upload, got %v", w.Code)
+	}
+
+	// without Content-Length
+	req, _ := http.NewRequest("PUT", "http://localhost/foo/bar.git/info/lfs/objects/"+oid, ioutil.NopCloser(bytes.NewBufferString(content)))
+	req.SetBasicAuth("sickill", "xxx")
+	w = httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != 413 {
+		t.Errorf("expected status 413 for too large chunked upload, got %v", w.Code)
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%v/lfs/objects/%v/%v/%v", fullRepoPath, oid[0:2], oid[2:4], oid)); err == nil {
+		t.Errorf("expected too large object not to be stored")
+	}
+}
@@ -5,11 +5,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
-	"net/http/cgi"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"gitorious.org/gitorious/gitorious-proto/api"
 	"gitorious.org/gitorious/gitorious-proto/common"
@@ -19,9 +23,54 @@ func say(w http.ResponseWriter, status int, s string, args ...interface{}) {
 	http.Error(w, fmt.Sprintf(s, args...), status)
 }
 
+func sayUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "30")
+	say(w, http.StatusServiceUnavailable, "Service temporarily unavailable, please try again later")
+}
+
+func sayMaintenance(w http.ResponseWriter, maintenance *common.Maintenance) {
+	w.Header().Set("Retry-After", "300")
+	say(w, http.StatusServiceUnavailable, "%v", maintenance.Message)
+}
+
+func sayLimited(w http.ResponseWriter, err *common.LimitError) {
+	w.Header().Set("Retry-After", "10")
+
+	if err.RateLimited {
+		say(w, http.StatusTooManyRequests, "Too many requests, please try again later")
+	} else {
+		say(w, http.StatusTooManyRequests, "Too many concurrent operations, please try again later")
+	}
+}
+
+func sayLockedOut(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	say(w, http.StatusTooManyRequests, "Too many failed authentication attempts, please try again later")
+}
+
 func requestBasicAuth(w http.ResponseWriter, s string) {
 	w.Header().Set("WWW-Authenticate", `Basic realm="Gitorious"`)
-	say(w, http.StatusUnauthorized, s)
+	say(w, http.StatusUnauthorized, "%v", s)
+}
+
+// bearerAuth returns the personal access token sent with
+// "Authorization: Bearer <token>" header.
+func bearerAuth(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(auth, "Bearer "), true
+}
+
+// tokenScope returns the access token scope required for a push or a fetch.
+func tokenScope(isPush bool) api.TokenScope {
+	if isPush {
+		return api.ScopeWrite
+	}
+
+	return api.ScopeRead
 }
 
 var pathRegexp = regexp.MustCompile("^/(.+\\.git)(/.+)$")
@@ -35,55 +84,261 @@ func parsePath(path string) (string, string, error) {
 	return matches[1], matches[2], nil
 }
 
-func createHttpEnv(username string, repoConfig *api.RepoConfig, translatedPath string) []string {
+func createHttpEnv(username string, repoConfig *api.RepoConfig, translatedPath, remoteAddr string) []string {
 	env := common.CreateEnv("http", username, repoConfig)
 
-	env = append(env, "REMOTE_USER="+username) // enables "receive-pack" service (push) in git-http-backend
-	env = append(env, "GIT_HTTP_EXPORT_ALL=1") // enables clones without "git-daemon-export-ok" magic file
+	// the same variables hooks used to get from git-http-backend CGI environment
+	env = append(env, "REMOTE_USER="+username)
+	env = append(env, "REMOTE_ADDR="+remoteAddr)
+	env = append(env, "GIT_HTTP_EXPORT_ALL=1")
 	env = append(env, "PATH_TRANSLATED="+translatedPath)
 
+	if username != "" { // reflog identity, as set by git-http-backend for pushes
+		env = append(env, "GIT_COMMITTER_NAME="+username)
+		env = append(env, fmt.Sprintf("GIT_COMMITTER_EMAIL=%v@http.%v", username, remoteAddr))
+	}
+
 	return env
 }
 
-func execGitHttpBackend(env []string, w http.ResponseWriter, req *http.Request) {
-	cgiHandler := &cgi.Handler{
-		Path: "/bin/sh",
-		Args: []string{"-c", "git http-backend"},
-		Dir:  ".",
-		Env:  env,
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
 	}
 
-	cgiHandler.ServeHTTP(w, req)
+	return host
 }
 
 type Handler struct {
 	logger      *log.Logger
 	internalApi api.InternalApi
+	lfsTokenKey []byte // LFS tokens are rejected when nil
+	logFormat   common.LogFormat
+	metrics     *httpMetrics   // not collected when nil
+	limiter     common.Limiter // no limits when nil
+	authCache   *authCache     // no caching when nil
+	authLockout *authLockout   // no lockout when nil
+	accessLog   *accessLog     // not written when nil
+
+	// uploaded LFS objects can be of any size when 0
+	lfsMaxObjectSize int64
+
+	// X-Forwarded-For and X-Forwarded-Proto are ignored unless sent by these
+	trustedProxies trustedProxies
+
+	// client certificates are ignored when nil
+	certificatesApi api.CertificatesApi
+
+	maintenanceFile string // see common.ReadMaintenance
+}
+
+// authenticateBasic returns the user with the given credentials, or the
+// access token given as password, possibly cached.
+func (h *Handler) authenticateBasic(usernameOrEmail, password string) (*api.User, *api.AccessToken, error) {
+	if entry := h.authCache.get("basic", usernameOrEmail, password); entry != nil {
+		return entry.user, entry.accessToken, nil
+	}
+
+	user, err := h.internalApi.AuthenticateUser(usernameOrEmail, password)
+	if err != nil || user != nil {
+		if user != nil {
+			h.authCache.set(&authCacheEntry{user: user}, "basic", usernameOrEmail, password)
+		}
+
+		return user, nil, err
+	}
+
+	// users with 2FA or SSO accounts send an access token as password
+	accessToken, err := h.internalApi.AuthenticateToken(password)
+	if accessToken != nil {
+		h.authCache.set(&authCacheEntry{accessToken: accessToken}, "basic", usernameOrEmail, password)
+	}
+
+	return nil, accessToken, err
+}
+
+// authenticateBearer returns the access token, possibly cached.
+func (h *Handler) authenticateBearer(token string) (*api.AccessToken, error) {
+	if entry := h.authCache.get("bearer", token); entry != nil {
+		return entry.accessToken, nil
+	}
+
+	accessToken, err := h.internalApi.AuthenticateToken(token)
+	if accessToken != nil {
+		h.authCache.set(&authCacheEntry{accessToken: accessToken}, "bearer", token)
+	}
+
+	return accessToken, err
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	logger := &common.SessionLogger{h.logger, req.RemoteAddr}
+	req, proxyAddr := h.trustedProxies.resolve(req)
+
+	logger := &common.SessionLogger{Target: h.logger, SessionId: req.RemoteAddr, Format: h.logFormat}
+	s := newSession(logger, h.metrics, h.accessLog, w, req)
+	w = s.w
+	defer s.finish()
+
+	if proxyAddr != "" {
+		logger.Printf("client connected through proxy %v (%v)", proxyAddr, requestScheme(req))
+	} else {
+		logger.Printf("client connected")
+	}
+
+	maintenance, err := common.ReadMaintenance(h.maintenanceFile)
+	if err != nil {
+		logger.Printf("%v, assuming read-only maintenance mode...", err)
+	}
 
-	logger.Printf("client connected")
+	if maintenance.Rejects(false) {
+		sayMaintenance(w, maintenance)
+		logger.Printf("%v maintenance mode, disconnecting...", maintenance.Mode)
+		return
+	}
 
 	var username string
+	var lfsToken *common.LfsToken
+	var accessToken *api.AccessToken
+
+	if token, ok := lfsTokenAuth(req); ok {
+		if h.lfsTokenKey == nil {
+			requestBasicAuth(w, "LFS tokens not supported")
+			s.auth = authInvalidToken
+			logger.Printf("no key for verifying LFS tokens, requesting basic auth, disconnecting...")
+			return
+		}
+
+		var err error
+		lfsToken, err = common.VerifyLfsToken(h.lfsTokenKey, token, time.Now())
+		if err != nil {
+			requestBasicAuth(w, "Invalid or expired LFS token")
+			s.auth = authInvalidToken
+			s.err = err
+			logger.Printf("%v, requesting basic auth, disconnecting...", err)
+			return
+		}
+
+		username = lfsToken.Username
+		s.username = username
+		s.auth = authLfsToken
+		logger.Printf("user authenticated as %v with LFS token", username)
+	} else if usernameOrEmail, password, ok := BasicAuth(req); ok {
+		ip := remoteHost(req.RemoteAddr)
+
+		if retryAfter, locked := h.authLockout.locked(usernameOrEmail, ip); locked {
+			sayLockedOut(w, retryAfter)
+			s.auth = authLockedOut
+			logger.Printf("too many failed attempts for %v from %v, locked out for %v, disconnecting...", usernameOrEmail, ip, retryAfter)
+			return
+		}
 
-	if usernameOrEmail, password, ok := BasicAuth(req); ok {
-		user, err := h.internalApi.AuthenticateUser(usernameOrEmail, password)
+		var user *api.User
+		var err error
+		user, accessToken, err = h.authenticateBasic(usernameOrEmail, password)
 		if err != nil {
+			s.auth = authError
+			if _, ok := err.(*api.UnavailableError); ok {
+				sayUnavailable(w)
+				s.err = err
+				logger.Printf("%v, disconnecting...", err)
+				return
+			}
+
 			say(w, http.StatusInternalServerError, "Error occured, please contact support")
+			s.err = err
 			logger.Printf("%v, disconnecting...", err)
 			return
 		}
 
 		if user != nil {
 			username = user.Username
+			s.username = username
+			s.auth = authSuccess
 			logger.Printf("user authenticated as %v", username)
+			h.authLockout.succeed(usernameOrEmail, ip)
+		} else if accessToken != nil {
+			username = accessToken.Username
+			s.username = username
+			s.auth = authAccessToken
+			logger.Printf("user authenticated as %v with access token", username)
+			// the Basic username is not checked with tokens, so it can't
+			// be trusted to clear failures of anyone else
+			h.authLockout.succeed(accessToken.Username, ip)
 		} else {
+			h.authLockout.fail(usernameOrEmail, ip)
 			requestBasicAuth(w, "Invalid username or password")
+			s.auth = authInvalidCredentials
 			logger.Printf("invalid credentials, requesting basic auth, disconnecting...")
 			return
 		}
+	} else if token, ok := bearerAuth(req); ok {
+		ip := remoteHost(req.RemoteAddr)
+
+		if retryAfter, locked := h.authLockout.locked("", ip); locked {
+			sayLockedOut(w, retryAfter)
+			s.auth = authLockedOut
+			logger.Printf("too many failed attempts from %v, locked out for %v, disconnecting...", ip, retryAfter)
+			return
+		}
+
+		var err error
+		accessToken, err = h.authenticateBearer(token)
+		if err != nil {
+			s.auth = authError
+			if _, ok := err.(*api.UnavailableError); ok {
+				sayUnavailable(w)
+				s.err = err
+				logger.Printf("%v, disconnecting...", err)
+				return
+			}
+
+			say(w, http.StatusInternalServerError, "Error occured, please contact support")
+			s.err = err
+			logger.Printf("%v, disconnecting...", err)
+			return
+		}
+
+		if accessToken == nil {
+			h.authLockout.fail("", ip)
+			requestBasicAuth(w, "Invalid, expired or revoked access token")
+			s.auth = authInvalidToken
+			logger.Printf("invalid access token, requesting basic auth, disconnecting...")
+			return
+		}
+
+		username = accessToken.Username
+		s.username = username
+		s.auth = authAccessToken
+		logger.Printf("user authenticated as %v with access token", username)
+	} else if subject, ok := clientCertificateSubject(req); ok && h.certificatesApi != nil {
+		user, err := h.certificatesApi.FindCertificateUser(subject)
+		if err != nil {
+			s.auth = authError
+			if _, ok := err.(*api.UnavailableError); ok {
+				sayUnavailable(w)
+				s.err = err
+				logger.Printf("%v, disconnecting...", err)
+				return
+			}
+
+			say(w, http.StatusInternalServerError, "Error occured, please contact support")
+			s.err = err
+			logger.Printf("%v, disconnecting...", err)
+			return
+		}
+
+		if user != nil {
+			username = user.Username
+			s.username = username
+			s.auth = authClientCert
+			logger.Printf("user authenticated as %v with client certificate %v", username, subject)
+		} else {
+			requestBasicAuth(w, "Unknown client certificate")
+			s.auth = authInvalidCredentials
+			logger.Printf("no user for client certificate %v, requesting basic auth, disconnecting...", subject)
+			return
+		}
 	}
 
 	logger.Printf("processing request: %v", req.URL.String())
@@ -91,11 +346,36 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	repoPath, slug, err := parsePath(req.URL.Path)
 	if err != nil {
 		say(w, http.StatusBadRequest, "Invalid command")
+		s.err = err
 		logger.Printf("%v, disconnecting...", err)
 		return
 	}
 
-	if (req.URL.Query().Get("service") == "git-receive-pack" || slug == "/git-receive-pack") && username == "" {
+	s.repoPath = repoPath
+	s.service = metricsService(slug, req)
+
+	lfsUpload := isLfsUpload(slug, req)
+	isPush := gitServiceName(slug, req) == "git-receive-pack" || lfsUpload
+
+	if maintenance.Rejects(isPush) {
+		sayMaintenance(w, maintenance)
+		logger.Printf("%v maintenance mode, denying push, disconnecting...", maintenance.Mode)
+		return
+	}
+
+	if lfsToken != nil && !(isLfsRequest(slug) && lfsToken.Allows(repoPath, lfsOperation(isPush))) {
+		say(w, http.StatusForbidden, "Access denied")
+		logger.Printf("LFS token for %v %v doesn't allow this request, disconnecting...", lfsToken.Operation, lfsToken.RepoPath)
+		return
+	}
+
+	if accessToken != nil && !accessToken.Allows(isPush) {
+		say(w, http.StatusForbidden, "Access token doesn't have %v scope", tokenScope(isPush))
+		logger.Printf("access token with scopes %v doesn't allow this request, disconnecting...", accessToken.Scopes)
+		return
+	}
+
+	if isPush && username == "" {
 		requestBasicAuth(w, "Anonymous pushing not allowed")
 		logger.Printf("denying anonymous push, requesting basic auth, disconnecting...")
 		return
@@ -106,22 +386,83 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		if httpErr, ok := err.(*api.HttpError); ok {
 			if httpErr.StatusCode == 403 {
 				requestBasicAuth(w, "Access denied")
+				s.err = err
 				logger.Printf("%v, requesting basic auth, disconnecting...", err)
 				return
 			} else if httpErr.StatusCode == 404 {
 				say(w, http.StatusNotFound, "Invalid repository path")
+				s.err = err
 				logger.Printf("%v, disconnecting...", err)
 				return
 			}
 		}
 
+		if _, ok := err.(*api.UnavailableError); ok {
+			sayUnavailable(w)
+			s.err = err
+			logger.Printf("%v, disconnecting...", err)
+			return
+		}
+
 		say(w, http.StatusInternalServerError, "Error occured, please contact support")
+		s.err = err
 		logger.Printf("%v, disconnecting...", err)
 		return
 	}
 
+	s.repositoryId = repoConfig.RepositoryId
 	logger.Printf("full repo path: %v", repoConfig.FullPath)
 
+	if isPush && repoConfig.WriteDenied() {
+		say(w, http.StatusForbidden, "You don't have write access to this repository")
+		logger.Printf("%v has %v access only, denying push, disconnecting...", username, repoConfig.AccessLevel)
+		return
+	}
+
+	// unlike pushes, there's no pre-receive hook to stop uploads later
+	if lfsUpload && !repoConfig.AccessLevel.CanWrite() {
+		say(w, http.StatusForbidden, "You don't have write access to this repository")
+		logger.Printf(`%v has "%v" access level, denying LFS upload, disconnecting...`, username, repoConfig.AccessLevel)
+		return
+	}
+
+	if h.limiter != nil {
+		release, err := h.limiter.Acquire(common.LimitKey{User: username, Ip: remoteHost(req.RemoteAddr), Repo: repoConfig.FullPath})
+		if err != nil {
+			if limitErr, ok := err.(*common.LimitError); ok {
+				sayLimited(w, limitErr)
+			} else {
+				say(w, http.StatusInternalServerError, "Error occured, please contact support")
+			}
+
+			s.err = err
+			logger.Printf("%v, disconnecting...", err)
+			return
+		}
+		defer release()
+	}
+
+	if isLfsRequest(slug) {
+		logger.Printf("serving LFS request")
+
+		header, expiresIn, err := lfsActionHeader(h.lfsTokenKey, username, repoPath, lfsOperation(isPush), req, time.Now())
+		if err != nil {
+			say(w, http.StatusInternalServerError, "Error occured, please contact support")
+			s.err = err
+			logger.Printf("%v, disconnecting...", err)
+			return
+		}
+
+		if err := serveLfs(newLfsStore(repoConfig.FullPath, h.lfsMaxObjectSize), repoPath, slug, header, expiresIn, w, req); err != nil {
+			s.err = err
+			logger.Printf("%v, disconnecting...", err)
+			return
+		}
+
+		logger.Printf("done")
+		return
+	}
+
 	if !common.PreReceiveHookExists(repoConfig.FullPath) {
 		say(w, http.StatusInternalServerError, "Error occurred, please contact support")
 		logger.Printf("pre-receive hook for %v is missing or is not executable, aborting...", repoConfig.FullPath)
@@ -129,29 +470,182 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	translatedPath := repoConfig.FullPath + slug
-	env := createHttpEnv(username, repoConfig, translatedPath)
+	env := createHttpEnv(username, repoConfig, translatedPath, remoteHost(req.RemoteAddr))
+	env = common.AppendGitProtocol(env, req.Header.Get("Git-Protocol"))
 
-	logger.Printf(`invoking git-http-backend with translated path "%v"`, translatedPath)
+	logger.Printf(`serving git request with translated path "%v"`, translatedPath)
 
-	execGitHttpBackend(env, w, req)
+	if err := serveGit(env, repoConfig.FullPath, slug, w, req); err != nil {
+		s.err = err
+		logger.Printf("%v, disconnecting...", err)
+		return
+	}
 
 	logger.Printf("done")
 }
 
+// exportHookEnv makes hooks run by git (gitorious-hook) reach the internal API
+// the same way we do, over a unix socket too, and sign their requests with the
+// same key.
+func exportHookEnv(apiUrl, apiSecretFile string) {
+	os.Setenv("GITORIOUS_INTERNAL_API_URL", apiUrl)
+	os.Setenv("GITORIOUS_INTERNAL_API_SECRET_FILE", apiSecretFile)
+}
+
+// newAdminServer serves metrics and cache invalidation on a listener separate
+// from the one exposed to git clients.
+func newAdminServer(registry *common.Registry, cache *api.CachingInternalApi) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+	mux.Handle("/cache/invalidate", cache.InvalidationHandler())
+
+	return &http.Server{Handler: mux}
+}
+
 func main() {
 	syscall.Umask(0022) // set umask for pushes
 
 	var (
-		internalApiUrl = flag.String("api-url", "http://localhost:3000/api/internal", "Gitorious internal API URL")
-		addr           = flag.String("l", ":6000", "Address/port to listen on")
+		internalApiUrl        = flag.String("api-url", "http://localhost:3000/api/internal", "Gitorious internal API URL")
+		apiConnectTimeout     = flag.Duration("api-connect-timeout", api.DefaultConnectTimeout, "Timeout for connecting to Gitorious internal API")
+		apiReadTimeout        = flag.Duration("api-read-timeout", api.DefaultReadTimeout, "Timeout for reading Gitorious internal API response")
+		apiLegacyAuth         = flag.Bool("api-legacy-auth", false, "Send credentials to Gitorious internal API in a query string (for older Gitorious versions)")
+		apiSecretFile         = flag.String("api-secret-file", os.Getenv("GITORIOUS_INTERNAL_API_SECRET_FILE"), "File with a key for signing Gitorious internal API requests")
+		apiRetries            = flag.Int("api-retries", api.DefaultMaxRetries, "How many times to retry failed Gitorious internal API requests")
+		repoConfigTtl         = flag.Duration("repo-config-ttl", 10*time.Second, "How long to cache repository configs (0 disables caching)")
+		repoConfigNegativeTtl = flag.Duration("repo-config-negative-ttl", 2*time.Second, "How long to cache \"repository not found\" responses")
+		authCacheTtl          = flag.Duration("auth-cache-ttl", 30*time.Second, "How long to cache successful authentications (0 disables caching)")
+		authMaxFailures       = flag.Int("auth-max-failures", 10, "Failed authentication attempts per username and client IP before locking the username out for that IP (0 disables lockout)")
+		authMaxIpFailures     = flag.Int("auth-max-ip-failures", 100, "Failed authentication attempts per client IP, for any usernames, before locking the IP out (0 for no limit)")
+		authLockoutDuration   = flag.Duration("auth-lockout", 15*time.Minute, "How long failed authentication attempts are counted and lockout lasts")
+		trustedProxyList      = flag.String("trusted-proxies", "", "Comma separated CIDRs of reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers are trusted")
+		addr                  = flag.String("l", ":6000", "Address/port to listen on")
+		logFormatName         = flag.String("log-format", "text", "Log format: text, json or logfmt")
+		accessLogPath         = flag.String("access-log", "", "File to write access log to (reopened on SIGUSR1, empty disables it)")
+		accessLogFormatName   = flag.String("access-log-format", "combined", "Access log format: combined or json")
+		adminAddr             = flag.String("admin-l", "localhost:6001", "Address/port to serve /metrics and /cache/invalidate on (empty disables it)")
+		maxPerUser            = flag.Int("max-per-user", 0, "Maximum concurrent operations per user (0 for no limit)")
+		maxPerIp              = flag.Int("max-per-ip", 0, "Maximum concurrent operations per client IP (0 for no limit)")
+		maxPerRepo            = flag.Int("max-per-repo", 0, "Maximum concurrent operations per repository (0 for no limit)")
+		rate                  = flag.Float64("rate", 0, "Requests per second allowed for each user and client IP (0 for no limit)")
+		rateBurst             = flag.Int("rate-burst", 10, "Requests allowed in a burst above -rate")
+		lfsMaxObjectSize      = flag.Int64("lfs-max-object-size", 2*1024*1024*1024, "Maximum size of uploaded Git LFS objects in bytes (0 for no limit)")
+		maintenanceFile       = flag.String("maintenance-file", common.DefaultMaintenanceFile, "Flag file turning maintenance mode on when present")
+		statsdAddr            = flag.String("statsd-l", "", "Address to receive gitorious-shell metrics on: udp://host:port or unix:///path/to/socket")
+		tlsCert               = flag.String("tls-cert", "", "TLS certificate (chain) file, enables HTTPS and HTTP/2 (reloaded on SIGUSR2)")
+		tlsKey                = flag.String("tls-key", "", "TLS private key file")
+		tlsClientCa           = flag.String("tls-client-ca", "", "CA certificates file for verifying client certificates, enables client certificate authentication")
+		shutdownTimeout       = flag.Duration("shutdown-timeout", 5*time.Minute, "How long to wait for requests in progress to finish on shutdown and restart")
 	)
 	flag.Parse()
 
-	logger := log.New(os.Stdout, "", log.LstdFlags)
-	internalApi := &api.GitoriousInternalApi{*internalApiUrl}
+	logFormat, err := common.ParseLogFormat(*logFormatName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	accessLogFormat, err := parseAccessLogFormat(*accessLogFormatName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logger := common.NewTargetLogger(os.Stdout, logFormat)
+	server := newServer(logger, *shutdownTimeout)
+
+	signingKey, err := api.LoadSigningKey(*apiSecretFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	exportHookEnv(*internalApiUrl, *apiSecretFile)
+
+	gitoriousApi := api.NewGitoriousInternalApi(*internalApiUrl)
+	gitoriousApi.ConnectTimeout = *apiConnectTimeout
+	gitoriousApi.ReadTimeout = *apiReadTimeout
+	gitoriousApi.MaxRetries = *apiRetries
+	gitoriousApi.SigningKey = signingKey
+	gitoriousApi.LegacyAuthentication = *apiLegacyAuth
+
+	registry := common.NewRegistry()
+	metrics := newHttpMetrics(registry)
+	// cache hits are not measured, only actual API calls
+	internalApi := api.NewCachingInternalApi(newInstrumentedInternalApi(gitoriousApi, registry), *repoConfigTtl, *repoConfigNegativeTtl)
+
+	if *statsdAddr != "" {
+		conn, err := server.listenPacket(statsdSocketName, *statsdAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logger.Printf("receiving gitorious-shell metrics on %v", *statsdAddr)
+		go newStatsdCollector(registry).run(conn, logger)
+	}
+
+	if *adminAddr != "" {
+		if _, err := server.listen(adminSocketName, *adminAddr); err != nil {
+			log.Fatal(err)
+		}
+
+		logger.Printf("serving metrics on %v", *adminAddr)
+		server.admin = newAdminServer(registry, internalApi)
+	}
+
+	// gitorious-shell issues LFS tokens signed with the same key
+	handler := &Handler{logger: logger, internalApi: internalApi, lfsTokenKey: signingKey, lfsMaxObjectSize: *lfsMaxObjectSize, logFormat: logFormat, metrics: metrics, maintenanceFile: *maintenanceFile}
+
+	if handler.trustedProxies, err = parseTrustedProxies(*trustedProxyList); err != nil {
+		log.Fatal(err)
+	}
+
+	if *accessLogPath != "" {
+		if server.accessLog, err = openAccessLog(*accessLogPath, accessLogFormat); err != nil {
+			log.Fatal(err)
+		}
+
+		handler.accessLog = server.accessLog
+	}
+
+	if *authCacheTtl > 0 {
+		if handler.authCache, err = newAuthCache(*authCacheTtl); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *authMaxFailures > 0 {
+		handler.authLockout = newAuthLockout(*authMaxFailures, *authMaxIpFailures, *authLockoutDuration)
+	}
+
+	limits := common.Limits{MaxPerUser: *maxPerUser, MaxPerIp: *maxPerIp, MaxPerRepo: *maxPerRepo, Rate: *rate, Burst: *rateBurst}
+	if limits.Enabled() {
+		handler.limiter = common.NewMemoryLimiter(limits)
+	}
+
+	server.http = &http.Server{Handler: handler}
+	scheme := "http"
+
+	if *tlsCert != "" || *tlsKey != "" {
+		if server.certs, err = newCertReloader(*tlsCert, *tlsKey); err != nil {
+			log.Fatal(err)
+		}
+
+		if server.http.TLSConfig, err = newTlsConfig(server.certs, *tlsClientCa); err != nil {
+			log.Fatal(err)
+		}
+
+		if *tlsClientCa != "" {
+			handler.certificatesApi = gitoriousApi
+		}
+
+		scheme = "https"
+	} else if *tlsClientCa != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	if _, err := server.listen(httpSocketName, *addr); err != nil {
+		log.Fatal(err)
+	}
 
-	logger.Printf("listening on %v", *addr)
+	logger.Printf("listening on %v (%v)", *addr, scheme)
 
-	http.Handle("/", &Handler{logger, internalApi})
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	server.run()
 }
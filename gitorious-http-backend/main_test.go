@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
 
 	"os"
 	"testing"
@@ -59,29 +67,45 @@ func prependEnvPath(path string) {
 
 type testInternalApi struct {
 	FullRepoPath string
+	AccessLevel  api.AccessLevel
+	Err          error
+	AccessTokens map[string]*api.AccessToken
 }
 
 func (a *testInternalApi) AuthenticateUser(username, password string) (*api.User, error) {
-	return &api.User{username + ":" + password}, nil
+	if _, ok := a.AccessTokens[password]; ok {
+		return nil, nil
+	}
+
+	return &api.User{Username: username + ":" + password}, nil
+}
+
+func (a *testInternalApi) AuthenticateToken(token string) (*api.AccessToken, error) {
+	return a.AccessTokens[token], nil
 }
 
 func (a *testInternalApi) GetRepoConfig(repoPath, username string) (*api.RepoConfig, error) {
-	return &api.RepoConfig{FullPath: a.FullRepoPath}, nil
+	if a.Err != nil {
+		return nil, a.Err
+	}
+
+	return &api.RepoConfig{FullPath: a.FullRepoPath, AccessLevel: a.AccessLevel}, nil
 }
 
 func TestHandler_ServeHTTP(t *testing.T) {
 	cwd, _ := os.Getwd()
-	prependEnvPath(filepath.Join(cwd, "fixtures", "git-http-backend"))
+	prependEnvPath(filepath.Join(cwd, "fixtures", "git-stateless-rpc"))
 
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
 	fullRepoPath := filepath.Join(cwd, "..", "common", "fixtures", "repos", "repo-with-hook.git")
-	internalApi := &testInternalApi{fullRepoPath}
+	internalApi := &testInternalApi{FullRepoPath: fullRepoPath}
 
-	handler := &Handler{logger, internalApi}
+	handler := &Handler{logger: logger, internalApi: internalApi}
 
 	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
 	req.SetBasicAuth("sickill", "xxx")
+	req.RemoteAddr = "1.2.3.4:5678"
 	w := httptest.NewRecorder()
 
 	handler.ServeHTTP(w, req)
@@ -90,11 +114,20 @@ func TestHandler_ServeHTTP(t *testing.T) {
 		t.Errorf("expected status 200, got %v", w.Code)
 	}
 
-	expectedBody := fmt.Sprintf(`GIT_HTTP_EXPORT_ALL=1
+	expectedContentType := "application/x-git-upload-pack-advertisement"
+	if w.Header().Get("Content-Type") != expectedContentType {
+		t.Errorf(`expected content type "%v", got "%v"`, expectedContentType, w.Header().Get("Content-Type"))
+	}
+
+	expectedBody := fmt.Sprintf(`001e# service=git-upload-pack
+0000upload-pack --stateless-rpc --advertise-refs %v
+GIT_COMMITTER_EMAIL=sickill:xxx@http.1.2.3.4
+GIT_COMMITTER_NAME=sickill:xxx
+GIT_HTTP_EXPORT_ALL=1
 PATH_TRANSLATED=%v/info/refs
-QUERY_STRING=service=git-upload-pack
+REMOTE_ADDR=1.2.3.4
 REMOTE_USER=sickill:xxx
-`, fullRepoPath)
+`, fullRepoPath, fullRepoPath)
 
 	actualBody := w.Body.String()
 
@@ -102,3 +135,449 @@ REMOTE_USER=sickill:xxx
 		t.Errorf(`expected body "%v", got "%v"`, expectedBody, actualBody)
 	}
 }
+
+func TestHandler_ServeHTTP_HookEnv(t *testing.T) {
+	cwd, _ := os.Getwd()
+	prependEnvPath(filepath.Join(cwd, "fixtures", "git-stateless-rpc"))
+
+	exportHookEnv("unix:///var/run/gitorious/api.sock", "/etc/gitorious/api-secret")
+	defer os.Unsetenv("GITORIOUS_INTERNAL_API_URL")
+	defer os.Unsetenv("GITORIOUS_INTERNAL_API_SECRET_FILE")
+
+	fullRepoPath := filepath.Join(cwd, "..", "common", "fixtures", "repos", "repo-with-hook.git")
+	handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: &testInternalApi{FullRepoPath: fullRepoPath}}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	req.SetBasicAuth("sickill", "xxx")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	for _, expected := range []string{"GITORIOUS_INTERNAL_API_URL=unix:///var/run/gitorious/api.sock\n", "GITORIOUS_INTERNAL_API_SECRET_FILE=/etc/gitorious/api-secret\n"} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected %q in git (and hooks) environment, got %q", expected, w.Body.String())
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_Rpc(t *testing.T) {
+	cwd, _ := os.Getwd()
+	prependEnvPath(filepath.Join(cwd, "fixtures", "git-stateless-rpc"))
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	fullRepoPath := filepath.Join(cwd, "..", "common", "fixtures", "repos", "repo-with-hook.git")
+	internalApi := &testInternalApi{FullRepoPath: fullRepoPath}
+
+	handler := &Handler{logger: logger, internalApi: internalApi}
+
+	var gzippedBody bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzippedBody)
+	gzipWriter.Write([]byte("0032want sha\n"))
+	gzipWriter.Close()
+
+	var tests = []struct {
+		service         string
+		body            io.Reader
+		contentEncoding string
+	}{
+		{"upload-pack", bytes.NewBufferString("0032want sha\n"), ""},
+		{"upload-pack", &gzippedBody, "gzip"},
+		{"receive-pack", bytes.NewBufferString("0032want sha\n"), ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://localhost/foo/bar.git/git-"+test.service, test.body)
+		req.Header.Set("Content-Type", "application/x-git-"+test.service+"-request")
+		req.Header.Set("Content-Encoding", test.contentEncoding)
+		req.SetBasicAuth("sickill", "xxx")
+		req.RemoteAddr = "1.2.3.4:5678"
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Errorf("expected status 200, got %v (%v)", w.Code, test)
+		}
+
+		expectedContentType := "application/x-git-" + test.service + "-result"
+		if w.Header().Get("Content-Type") != expectedContentType {
+			t.Errorf(`expected content type "%v", got "%v"`, expectedContentType, w.Header().Get("Content-Type"))
+		}
+
+		expectedBody := fmt.Sprintf(`%v --stateless-rpc %v
+GIT_COMMITTER_EMAIL=sickill:xxx@http.1.2.3.4
+GIT_COMMITTER_NAME=sickill:xxx
+GIT_HTTP_EXPORT_ALL=1
+PATH_TRANSLATED=%v/git-%v
+REMOTE_ADDR=1.2.3.4
+REMOTE_USER=sickill:xxx
+0032want sha
+`, test.service, fullRepoPath, fullRepoPath, test.service)
+
+		actualBody := w.Body.String()
+
+		if actualBody != expectedBody {
+			t.Errorf(`expected body "%v", got "%v"`, expectedBody, actualBody)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_Errors(t *testing.T) {
+	cwd, _ := os.Getwd()
+	prependEnvPath(filepath.Join(cwd, "fixtures", "git-stateless-rpc"))
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	fullRepoPath := filepath.Join(cwd, "..", "common", "fixtures", "repos", "repo-with-hook.git")
+	internalApi := &testInternalApi{FullRepoPath: fullRepoPath}
+
+	handler := &Handler{logger: logger, internalApi: internalApi}
+
+	var tests = []struct {
+		method         string
+		url            string
+		contentType    string
+		authenticate   bool
+		expectedStatus int
+	}{
+		{"GET", "/foo/bar.git/info/refs?service=git-receive-pack", "", false, 401},
+		{"POST", "/foo/bar.git/git-receive-pack", "application/x-git-receive-pack-request", false, 401},
+		{"GET", "/foo/bar.git/info/refs?service=git-upload-archive", "", true, 403},
+		{"POST", "/foo/bar.git/info/refs?service=git-upload-pack", "", true, 405},
+		{"GET", "/foo/bar.git/git-upload-pack", "", true, 405},
+		{"POST", "/foo/bar.git/git-upload-pack", "text/plain", true, 415},
+		{"GET", "/foo/bar.git/config", "", true, 404},
+		{"GET", "/foo/bar.git/objects/info/packs", "", true, 404},
+		{"GET", "/foo/bar.git/HEAD", "", false, 200},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://localhost"+test.url, nil)
+		req.Header.Set("Content-Type", test.contentType)
+		if test.authenticate {
+			req.SetBasicAuth("sickill", "xxx")
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_Unavailable(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	internalApi := &testInternalApi{Err: &api.UnavailableError{Err: api.ErrCircuitOpen}}
+
+	handler := &Handler{logger: logger, internalApi: internalApi}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != 503 {
+		t.Errorf("expected status 503, got %v", w.Code)
+	}
+
+	expectedBody := "Service temporarily unavailable, please try again later\n"
+	if w.Body.String() != expectedBody {
+		t.Errorf(`expected body "%v", got "%v"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestHandler_ServeHTTP_Limited(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	internalApi := &testInternalApi{FullRepoPath: "/tmp/foo/bar.git"}
+	limiter := common.NewMemoryLimiter(common.Limits{MaxPerRepo: 1})
+
+	handler := &Handler{logger: logger, internalApi: internalApi, limiter: limiter}
+
+	release, _ := limiter.Acquire(common.LimitKey{Repo: "/tmp/foo/bar.git"})
+	defer release()
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != 429 {
+		t.Errorf("expected status 429, got %v", w.Code)
+	}
+
+	expectedBody := "Too many concurrent operations, please try again later\n"
+	if w.Body.String() != expectedBody {
+		t.Errorf(`expected body "%v", got "%v"`, expectedBody, w.Body.String())
+	}
+}
+
+func TestHandler_ServeHTTP_Maintenance(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "maintenance")
+	defer os.RemoveAll(dir)
+
+	maintenanceFile := filepath.Join(dir, "maintenance")
+	fullRepoPath := filepath.Join(dir, "bar.git")
+	os.MkdirAll(filepath.Join(fullRepoPath, "hooks"), 0755)
+	ioutil.WriteFile(filepath.Join(fullRepoPath, "hooks", "pre-receive"), []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(fullRepoPath, "HEAD"), []byte("ref: refs/heads/master\n"), 0644)
+
+	internalApi := &testInternalApi{FullRepoPath: fullRepoPath}
+	handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: internalApi, maintenanceFile: maintenanceFile}
+
+	var tests = []struct {
+		mode           string
+		url            string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"read-only\nMigrating storage", "/foo/bar.git/info/refs?service=git-receive-pack", 503, "Migrating storage\n"},
+		{"read-only\nMigrating storage", "/foo/bar.git/git-receive-pack", 503, "Migrating storage\n"},
+		{"read-only\nMigrating storage", "/foo/bar.git/HEAD", 200, "ref: refs/heads/master\n"},
+		{"full", "/foo/bar.git/HEAD", 503, "Gitorious is down for maintenance, please try again later\n"},
+	}
+
+	for _, test := range tests {
+		ioutil.WriteFile(maintenanceFile, []byte(test.mode), 0644)
+
+		req, _ := http.NewRequest("GET", "http://localhost"+test.url, nil)
+		req.SetBasicAuth("sickill", "xxx")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+
+		if w.Body.String() != test.expectedBody {
+			t.Errorf("expected body %q, got %q (%v)", test.expectedBody, w.Body.String(), test)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_ReadOnlyAccess(t *testing.T) {
+	cwd, _ := os.Getwd()
+	prependEnvPath(filepath.Join(cwd, "fixtures", "git-stateless-rpc"))
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
+	fullRepoPath := filepath.Join(cwd, "..", "common", "fixtures", "repos", "repo-with-hook.git")
+	internalApi := &testInternalApi{FullRepoPath: fullRepoPath, AccessLevel: api.AccessRead}
+
+	handler := &Handler{logger: logger, internalApi: internalApi}
+
+	var tests = []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/foo/bar.git/info/refs?service=git-upload-pack", 200},
+		{"/foo/bar.git/info/refs?service=git-receive-pack", 403},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+test.url, nil)
+		req.SetBasicAuth("sickill", "xxx")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+	}
+}
+
+// PATH before tests prepended fake git fixtures to it
+var originalPath = os.Getenv("PATH")
+
+// createTestRepo creates a bare repository with master and feature branches
+// and v1.0 tag, all pointing to the same commit.
+func createTestRepo(t *testing.T) string {
+	dir, _ := ioutil.TempDir("", "gitorious-http-backend")
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "PATH="+originalPath, "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v failed: %v", args, err)
+		}
+
+		return strings.TrimSpace(string(output))
+	}
+
+	git("init", "-q", "--bare", ".")
+	commit := git("commit-tree", git("mktree"), "-m", "initial commit")
+	git("update-ref", "refs/heads/master", commit)
+	git("update-ref", "refs/heads/feature", commit)
+	git("update-ref", "refs/tags/v1.0", commit)
+
+	ioutil.WriteFile(filepath.Join(dir, "hooks", "pre-receive"), []byte("#!/bin/sh\n"), 0755)
+
+	return dir
+}
+
+func TestHandler_ServeHTTP_ProtocolV2(t *testing.T) {
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", originalPath)
+	defer os.Setenv("PATH", path)
+
+	fullRepoPath := createTestRepo(t)
+	defer os.RemoveAll(fullRepoPath)
+
+	handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: &testInternalApi{FullRepoPath: fullRepoPath}}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Git-Protocol", "version=2")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if !strings.HasPrefix(w.Body.String(), "000eversion 2\n") || !strings.Contains(w.Body.String(), "ls-refs") {
+		t.Errorf("expected protocol v2 capability advertisement without service header, got %q", w.Body.String())
+	}
+
+	body := &bytes.Buffer{}
+	common.WritePacket(body, "command=ls-refs\n")
+	body.WriteString("0001") // delimiter packet
+	common.WritePacket(body, "ref-prefix refs/heads/\n")
+	common.WriteFlushPacket(body)
+
+	req, _ = http.NewRequest("POST", "http://localhost/foo/bar.git/git-upload-pack", body)
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Git-Protocol", "version=2")
+	w = httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	output := w.Body.String()
+
+	if w.Code != 200 || !strings.Contains(output, " refs/heads/master\n") || !strings.Contains(output, " refs/heads/feature\n") {
+		t.Errorf("expected branches to be listed, got %v %q", w.Code, output)
+	}
+
+	if strings.Contains(output, "refs/tags/v1.0") {
+		t.Errorf("expected refs to be filtered by prefix, got %q", output)
+	}
+}
+
+func TestHandler_ServeHTTP_Summary(t *testing.T) {
+	var buf bytes.Buffer
+
+	internalApi := &testInternalApi{Err: &api.HttpError{StatusCode: 404}}
+	handler := &Handler{logger: log.New(&buf, "", 0), internalApi: internalApi, logFormat: common.LogFormatJson}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	req.SetBasicAuth("sickill", "xxx")
+	req.RemoteAddr = "1.2.3.4:5678"
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	var summary map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+		t.Fatalf("expected JSON record, got %q (%v)", lines[len(lines)-1], err)
+	}
+
+	expected := map[string]interface{}{
+		"session":   "1.2.3.4:5678",
+		"msg":       "request finished",
+		"user":      "sickill:xxx",
+		"repo":      "foo/bar.git",
+		"protocol":  "http",
+		"command":   "GET /foo/bar.git/info/refs",
+		"status":    float64(404),
+		"bytes_out": float64(len(w.Body.String())),
+		"error":     "got HTTP status 404 for <nil>",
+	}
+
+	for key, value := range expected {
+		if summary[key] != value {
+			t.Errorf("expected %v to be %v, got %v", key, value, summary[key])
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_AccessToken(t *testing.T) {
+	var buf bytes.Buffer
+
+	internalApi := &testInternalApi{
+		Err: &api.HttpError{StatusCode: 404},
+		AccessTokens: map[string]*api.AccessToken{
+			"r3ad":  {Username: "sickill", Scopes: []api.TokenScope{api.ScopeRead}},
+			"wr1te": {Username: "sickill", Scopes: []api.TokenScope{api.ScopeWrite}},
+			"n0ne":  {Username: "sickill"},
+		},
+	}
+	handler := &Handler{logger: log.New(&buf, "", 0), internalApi: internalApi}
+
+	var tests = []struct {
+		authorization  string
+		basicPassword  string
+		service        string
+		expectedStatus int
+		expectedLog    string
+	}{
+		{"Bearer r3ad", "", "git-upload-pack", 404, "user authenticated as sickill with access token"},
+		{"Bearer r3ad", "", "git-receive-pack", 403, "access token with scopes [read] doesn't allow this request"},
+		{"Bearer wr1te", "", "git-upload-pack", 404, "user authenticated as sickill with access token"},
+		{"Bearer wr1te", "", "git-receive-pack", 404, "user authenticated as sickill with access token"},
+		{"Bearer n0ne", "", "git-upload-pack", 403, "access token with scopes [] doesn't allow this request"},
+		{"Bearer revoked", "", "git-upload-pack", 401, "invalid access token"},
+		{"", "r3ad", "git-upload-pack", 404, "user authenticated as sickill with access token"},
+		{"", "r3ad", "git-receive-pack", 403, "access token with scopes [read] doesn't allow this request"},
+		{"", "secret", "git-receive-pack", 404, "user authenticated as sickill:secret"},
+	}
+
+	for _, test := range tests {
+		buf.Reset()
+
+		req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service="+test.service, nil)
+		if test.basicPassword != "" {
+			req.SetBasicAuth("sickill", test.basicPassword)
+		} else {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, w.Code, test)
+		}
+
+		if !strings.Contains(buf.String(), test.expectedLog) {
+			t.Errorf("expected log to contain %q, got %q (%v)", test.expectedLog, buf.String(), test)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_WrongPasswordWithoutTokenSupport(t *testing.T) {
+	// older Gitorious, without /authenticate-token
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/authenticate" {
+			w.WriteHeader(401)
+		} else {
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: api.NewGitoriousInternalApi(server.URL)}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	req.SetBasicAuth("sickill", "typo")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected basic auth challenge, got %v (%v)", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+// number of git processes currently serving requests
+var gitProcessesInFlight int64
+
+// authentication outcomes
+const (
+	authAnonymous          = "anonymous"
+	authSuccess            = "success"
+	authLfsToken           = "lfs_token"
+	authClientCert         = "client_cert"
+	authAccessToken        = "access_token"
+	authInvalidCredentials = "invalid_credentials"
+	authInvalidToken       = "invalid_token"
+	authLockedOut          = "locked_out"
+	authError              = "error"
+)
+
+type httpMetrics struct {
+	requests        *common.CounterVec
+	requestDuration *common.HistogramVec
+	auth            *common.CounterVec
+}
+
+func newHttpMetrics(registry *common.Registry) *httpMetrics {
+	registry.NewGaugeFunc("gitorious_http_git_processes_in_flight", "Number of git processes currently serving requests.", func() float64 {
+		return float64(atomic.LoadInt64(&gitProcessesInFlight))
+	})
+
+	return &httpMetrics{
+		requests:        registry.NewCounterVec("gitorious_http_requests_total", "Number of handled requests.", "service", "status"),
+		requestDuration: registry.NewHistogramVec("gitorious_http_request_duration_seconds", "Time spent handling requests.", common.DefaultBuckets, "service"),
+		auth:            registry.NewCounterVec("gitorious_http_auth_total", "Number of requests by authentication outcome.", "outcome"),
+	}
+}
+
+// observe records a handled request. It's a no-op on nil metrics.
+func (m *httpMetrics) observe(service string, status int, auth string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	if status == 0 { // nothing written, net/http responds with 200
+		status = http.StatusOK
+	}
+
+	m.requests.Inc(service, strconv.Itoa(status))
+	m.requestDuration.Observe(duration.Seconds(), service)
+	m.auth.Inc(auth)
+}
+
+// metricsService returns a label value for the kind of request.
+func metricsService(slug string, req *http.Request) string {
+	switch {
+	case isLfsRequest(slug):
+		return "lfs"
+	case slug == "/info/refs" && req.URL.Query().Get("service") != "":
+		return "info/refs"
+	case slug == "/git-upload-pack":
+		return "upload-pack"
+	case slug == "/git-receive-pack":
+		return "receive-pack"
+	case dumbPathRegexp.MatchString(slug):
+		return "dumb"
+	}
+
+	return "other"
+}
+
+// instrumentedInternalApi measures latency and errors of internal API calls.
+type instrumentedInternalApi struct {
+	api      api.InternalApi
+	duration *common.HistogramVec
+	errors   *common.CounterVec
+}
+
+func newInstrumentedInternalApi(internalApi api.InternalApi, registry *common.Registry) *instrumentedInternalApi {
+	return &instrumentedInternalApi{
+		api:      internalApi,
+		duration: registry.NewHistogramVec("gitorious_internal_api_request_duration_seconds", "Time spent waiting for Gitorious internal API.", common.DefaultBuckets, "method"),
+		errors:   registry.NewCounterVec("gitorious_internal_api_errors_total", "Number of failed Gitorious internal API calls.", "method", "error"),
+	}
+}
+
+func (a *instrumentedInternalApi) GetRepoConfig(repoPath, username string) (*api.RepoConfig, error) {
+	start := time.Now()
+	repoConfig, err := a.api.GetRepoConfig(repoPath, username)
+	a.observe("GetRepoConfig", start, err)
+
+	return repoConfig, err
+}
+
+func (a *instrumentedInternalApi) AuthenticateUser(username, password string) (*api.User, error) {
+	start := time.Now()
+	user, err := a.api.AuthenticateUser(username, password)
+	a.observe("AuthenticateUser", start, err)
+
+	return user, err
+}
+
+func (a *instrumentedInternalApi) AuthenticateToken(token string) (*api.AccessToken, error) {
+	start := time.Now()
+	accessToken, err := a.api.AuthenticateToken(token)
+	a.observe("AuthenticateToken", start, err)
+
+	return accessToken, err
+}
+
+func (a *instrumentedInternalApi) observe(method string, start time.Time, err error) {
+	a.duration.Observe(time.Since(start).Seconds(), method)
+
+	if err != nil {
+		a.errors.Inc(method, apiErrorLabel(err))
+	}
+}
+
+// apiErrorLabel returns HTTP status for errors returned by the API and
+// "unavailable" when it couldn't be reached.
+func apiErrorLabel(err error) string {
+	switch err := err.(type) {
+	case *api.HttpError:
+		return strconv.Itoa(err.StatusCode)
+	case *api.UnavailableError:
+		return "unavailable"
+	}
+
+	return "other"
+}
+
+// statsdCollector receives session metrics reported by gitorious-shell (which
+// exits before it could be scraped) and serves them along with ours. Per-user
+// and per-repository tags are dropped to keep the number of series bounded.
+type statsdCollector struct {
+	sessions *common.CounterVec
+	duration *common.HistogramVec
+	bytesIn  *common.CounterVec
+	bytesOut *common.CounterVec
+}
+
+func newStatsdCollector(registry *common.Registry) *statsdCollector {
+	return &statsdCollector{
+		sessions: registry.NewCounterVec("gitorious_ssh_sessions_total", "Number of SSH sessions.", "command", "reason"),
+		duration: registry.NewHistogramVec("gitorious_ssh_session_duration_seconds", "Duration of SSH sessions.", common.DefaultBuckets, "command"),
+		bytesIn:  registry.NewCounterVec("gitorious_ssh_bytes_in_total", "Bytes received from SSH clients.", "command"),
+		bytesOut: registry.NewCounterVec("gitorious_ssh_bytes_out_total", "Bytes sent to SSH clients.", "command"),
+	}
+}
+
+func (c *statsdCollector) collect(metric *common.StatsdMetric) {
+	if metric.Value < 0 { // counters only go up
+		return
+	}
+
+	command := metric.Tag("command")
+
+	switch {
+	case metric.Name == "gitorious_ssh_sessions_total" && metric.Type == "c":
+		c.sessions.Add(metric.Value, command, metric.Tag("reason"))
+	case metric.Name == "gitorious_ssh_session_duration" && metric.Type == "ms":
+		c.duration.Observe(metric.Value/1000, command)
+	case metric.Name == "gitorious_ssh_bytes_in_total" && metric.Type == "c":
+		c.bytesIn.Add(metric.Value, command)
+	case metric.Name == "gitorious_ssh_bytes_out_total" && metric.Type == "c":
+		c.bytesOut.Add(metric.Value, command)
+	}
+}
+
+// collectDatagram collects newline separated metrics, ignoring unknown ones.
+func (c *statsdCollector) collectDatagram(datagram string, logger *log.Logger) {
+	for _, line := range strings.Split(datagram, "\n") {
+		if line == "" {
+			continue
+		}
+
+		metric, err := common.ParseStatsdMetric(line)
+		if err != nil {
+			logger.Printf("%v, ignoring...", err)
+			continue
+		}
+
+		c.collect(metric)
+	}
+}
+
+func (c *statsdCollector) run(conn net.PacketConn, logger *log.Logger) {
+	buf := make([]byte, 65536)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			logger.Printf("failed to receive metrics: %v", err)
+			return
+		}
+
+		c.collectDatagram(string(buf[:n]), logger)
+	}
+}
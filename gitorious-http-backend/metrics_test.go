@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+func TestMetricsService(t *testing.T) {
+	var tests = []struct {
+		url             string
+		expectedService string
+	}{
+		{"/foo/bar.git/info/refs?service=git-upload-pack", "info/refs"},
+		{"/foo/bar.git/info/refs?service=git-receive-pack", "info/refs"},
+		{"/foo/bar.git/info/refs", "dumb"},
+		{"/foo/bar.git/git-upload-pack", "upload-pack"},
+		{"/foo/bar.git/git-receive-pack", "receive-pack"},
+		{"/foo/bar.git/info/lfs/objects/batch", "lfs"},
+		{"/foo/bar.git/HEAD", "dumb"},
+		{"/foo/bar.git/config", "other"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost"+test.url, nil)
+		_, slug, _ := parsePath(req.URL.Path)
+
+		if service := metricsService(slug, req); service != test.expectedService {
+			t.Errorf("expected service %v, got %v (%v)", test.expectedService, service, test)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_Metrics(t *testing.T) {
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", originalPath)
+	defer os.Setenv("PATH", path)
+
+	fullRepoPath := createTestRepo(t)
+	defer os.RemoveAll(fullRepoPath)
+
+	registry := common.NewRegistry()
+	internalApi := newInstrumentedInternalApi(&testInternalApi{FullRepoPath: fullRepoPath}, registry)
+	handler := &Handler{logger: log.New(ioutil.Discard, "", 0), internalApi: internalApi, metrics: newHttpMetrics(registry)}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	req.SetBasicAuth("sickill", "xxx")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("POST", "http://localhost/foo/bar.git/git-receive-pack", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	internalApi.api = &testInternalApi{Err: &api.HttpError{StatusCode: 404}}
+	req, _ = http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var buf bytes.Buffer
+	registry.WriteText(&buf)
+	output := buf.String()
+
+	expectedLines := []string{
+		`gitorious_http_requests_total{service="info/refs",status="200"} 1`,
+		`gitorious_http_requests_total{service="info/refs",status="404"} 1`,
+		`gitorious_http_requests_total{service="receive-pack",status="401"} 1`,
+		`gitorious_http_request_duration_seconds_count{service="info/refs"} 2`,
+		`gitorious_http_auth_total{outcome="anonymous"} 2`,
+		`gitorious_http_auth_total{outcome="success"} 1`,
+		`gitorious_internal_api_request_duration_seconds_count{method="AuthenticateUser"} 1`,
+		`gitorious_internal_api_request_duration_seconds_count{method="GetRepoConfig"} 2`,
+		`gitorious_internal_api_errors_total{method="GetRepoConfig",error="404"} 1`,
+		"gitorious_http_git_processes_in_flight 0",
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%v", line, output)
+		}
+	}
+}
+
+func TestStatsdCollector(t *testing.T) {
+	registry := common.NewRegistry()
+	collector := newStatsdCollector(registry)
+
+	collector.collectDatagram(strings.Join([]string{
+		"gitorious_ssh_sessions_total:1|c|#command:upload-pack,reason:ok,user:sickill,repository_id:1",
+		"gitorious_ssh_session_duration:1500|ms|#command:upload-pack,reason:ok,user:sickill,repository_id:1",
+		"gitorious_ssh_bytes_in_total:100|c|#command:upload-pack,reason:ok",
+		"gitorious_ssh_bytes_out_total:2000|c|#command:upload-pack,reason:ok",
+		"gitorious_ssh_bytes_out_total:-2000|c|#command:upload-pack,reason:ok",
+		"gitorious_ssh_sessions_total:1|c|#command:receive-pack,reason:access_denied",
+		"some_other_metric:1|c",
+		"garbage",
+	}, "\n"), log.New(ioutil.Discard, "", 0))
+
+	var buf bytes.Buffer
+	registry.WriteText(&buf)
+	output := buf.String()
+
+	expectedLines := []string{
+		`gitorious_ssh_sessions_total{command="receive-pack",reason="access_denied"} 1`,
+		`gitorious_ssh_sessions_total{command="upload-pack",reason="ok"} 1`,
+		`gitorious_ssh_session_duration_seconds_sum{command="upload-pack"} 1.5`,
+		`gitorious_ssh_bytes_in_total{command="upload-pack"} 100`,
+		`gitorious_ssh_bytes_out_total{command="upload-pack"} 2000`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%v", line, output)
+		}
+	}
+}
+
+func TestAdminServer_CacheInvalidate(t *testing.T) {
+	backend := &testInternalApi{AccessLevel: api.AccessWrite}
+	cache := api.NewCachingInternalApi(backend, time.Hour, time.Second)
+	admin := newAdminServer(common.NewRegistry(), cache)
+
+	cache.GetRepoConfig("foo/bar.git", "sickill")
+
+	// access revoked in Gitorious
+	backend.AccessLevel = api.AccessRead
+
+	if repoConfig, _ := cache.GetRepoConfig("foo/bar.git", "sickill"); repoConfig.AccessLevel != api.AccessWrite {
+		t.Fatalf("expected cached access level, got %v", repoConfig.AccessLevel)
+	}
+
+	req := httptest.NewRequest("POST", "/cache/invalidate?repo_path=foo%2Fbar.git", nil)
+	w := httptest.NewRecorder()
+
+	admin.Handler.ServeHTTP(w, req)
+
+	if w.Code != 204 {
+		t.Errorf("expected status 204, got %v", w.Code)
+	}
+
+	if repoConfig, _ := cache.GetRepoConfig("foo/bar.git", "sickill"); repoConfig.AccessLevel != api.AccessRead {
+		t.Errorf("expected revoked access level after invalidation, got %v", repoConfig.AccessLevel)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are networks of reverse proxies (like nginx) whose
+// X-Forwarded-For and X-Forwarded-Proto headers are trusted.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses comma separated list of CIDRs or single IPs.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var proxies trustedProxies
+
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf(`invalid trusted proxy "%v"`, cidr))
+			}
+
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(`invalid trusted proxy "%v"`, cidr))
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIp returns the client's IP from X-Forwarded-For header of a request
+// made by a trusted proxy: the rightmost address not belonging to a trusted
+// proxy, as the ones on the left could be sent by the client.
+func (p trustedProxies) clientIp(proxyIp string, req *http.Request) string {
+	var forwardedFor []string
+	for _, header := range req.Header["X-Forwarded-For"] {
+		forwardedFor = append(forwardedFor, strings.Split(header, ",")...)
+	}
+
+	ip := proxyIp
+
+	for i := len(forwardedFor) - 1; i >= 0 && p.contains(ip); i-- {
+		addr := strings.TrimSpace(forwardedFor[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+
+		ip = addr
+	}
+
+	return ip
+}
+
+// resolve returns the request with RemoteAddr set to the client's IP and
+// URL.Scheme set to the scheme it used, when it was made by a trusted proxy,
+// and the proxy's address. Otherwise the request is returned as it is.
+func (p trustedProxies) resolve(req *http.Request) (*http.Request, string) {
+	proxyAddr := req.RemoteAddr
+	if !p.contains(remoteHost(proxyAddr)) {
+		return req, ""
+	}
+
+	r := new(http.Request)
+	*r = *req
+	url := *req.URL
+	r.URL = &url
+
+	r.RemoteAddr = p.clientIp(remoteHost(proxyAddr), req)
+
+	// the first proxy knows what the client used
+	proto := strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0])
+	if proto == "http" || proto == "https" {
+		r.URL.Scheme = proto
+	}
+
+	return r, proxyAddr
+}
+
+// requestScheme returns the scheme the client used, http or https.
+func requestScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return req.URL.Scheme
+	}
+
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	var tests = []struct {
+		input         string
+		expected      []string
+		expectedError bool
+	}{
+		{"", nil, false},
+		{"10.0.0.0/8, 127.0.0.1", []string{"10.0.0.0/8", "127.0.0.1/32"}, false},
+		{"::1,fd00::/8", []string{"::1/128", "fd00::/8"}, false},
+		{"10.0.0.0/33", nil, true},
+		{"nginx", nil, true},
+	}
+
+	for _, test := range tests {
+		proxies, err := parseTrustedProxies(test.input)
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("expected error: %v, got %v (%v)", test.expectedError, err, test)
+			continue
+		}
+
+		var actual []string
+		for _, network := range proxies {
+			actual = append(actual, network.String())
+		}
+
+		if strings.Join(actual, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("expected %v, got %v (%v)", test.expected, actual, test)
+		}
+	}
+}
+
+func TestTrustedProxies_Resolve(t *testing.T) {
+	proxies, _ := parseTrustedProxies("10.0.0.0/8,::1")
+
+	var tests = []struct {
+		remoteAddr         string
+		forwardedFor       []string
+		forwardedProto     string
+		expectedRemoteAddr string
+		expectedScheme     string
+		expectedProxyAddr  string
+	}{
+		{"1.2.3.4:5678", []string{"6.6.6.6"}, "https", "1.2.3.4:5678", "http", ""},
+		{"10.0.0.1:5678", []string{"1.2.3.4"}, "https", "1.2.3.4", "https", "10.0.0.1:5678"},
+		{"[::1]:5678", []string{"2001:db8::1"}, "", "2001:db8::1", "http", "[::1]:5678"},
+		// client sent its own X-Forwarded-For, passed through 2 proxies
+		{"10.0.0.1:5678", []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"}, "https, http", "1.2.3.4", "https", "10.0.0.1:5678"},
+		{"10.0.0.1:5678", []string{"garbage, 10.0.0.2"}, "ftp", "10.0.0.2", "http", "10.0.0.1:5678"},
+		{"10.0.0.1:5678", nil, "", "10.0.0.1", "http", "10.0.0.1:5678"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header["X-Forwarded-For"] = test.forwardedFor
+		if test.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+		}
+		req.URL.Scheme = "" // like in server requests
+
+		resolved, proxyAddr := proxies.resolve(req)
+
+		if resolved.RemoteAddr != test.expectedRemoteAddr {
+			t.Errorf("expected remote address %v, got %v (%v)", test.expectedRemoteAddr, resolved.RemoteAddr, test)
+		}
+
+		if scheme := requestScheme(resolved); scheme != test.expectedScheme {
+			t.Errorf("expected scheme %v, got %v (%v)", test.expectedScheme, scheme, test)
+		}
+
+		if proxyAddr != test.expectedProxyAddr {
+			t.Errorf("expected proxy address %q, got %q (%v)", test.expectedProxyAddr, proxyAddr, test)
+		}
+
+		if req.RemoteAddr != test.remoteAddr {
+			t.Errorf("expected original request not to be modified (%v)", test)
+		}
+	}
+}
+
+func TestHandler_ServeHTTP_TrustedProxy(t *testing.T) {
+	cwd, _ := os.Getwd()
+	prependEnvPath(filepath.Join(cwd, "fixtures", "git-stateless-rpc"))
+
+	var buf bytes.Buffer
+
+	fullRepoPath := filepath.Join(cwd, "..", "common", "fixtures", "repos", "repo-with-hook.git")
+	proxies, _ := parseTrustedProxies("10.0.0.0/8")
+	handler := &Handler{logger: log.New(&buf, "", 0), internalApi: &testInternalApi{FullRepoPath: fullRepoPath}, trustedProxies: proxies}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo/bar.git/info/refs?service=git-upload-pack", nil)
+	req.SetBasicAuth("sickill", "xxx")
+	req.RemoteAddr = "10.0.0.1:5678"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "REMOTE_ADDR=1.2.3.4\n") {
+		t.Errorf("expected client IP in hook environment, got %q", w.Body.String())
+	}
+
+	if !strings.Contains(buf.String(), "[1.2.3.4] client connected through proxy 10.0.0.1:5678 (https)") {
+		t.Errorf("expected session to be logged with client IP, got %q", buf.String())
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+// names of sockets passed by systemd (FileDescriptorName= of the socket unit)
+// or handed off to the new process on SIGHUP
+const (
+	httpSocketName   = "http"
+	adminSocketName  = "admin"
+	statsdSocketName = "statsd"
+)
+
+// how long the old process waits for the new one to start on SIGHUP
+const handoffTimeout = 30 * time.Second
+
+// inheritedSockets returns sockets passed with systemd socket activation
+// protocol, or by the previous process on SIGHUP, by name. The environment
+// variables describing them are cleared, so git processes don't see them.
+func inheritedSockets() map[string]*os.File {
+	sockets := make(map[string]*os.File)
+
+	var count int
+	var names []string
+
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		count, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	} else if fdNames := os.Getenv("GITORIOUS_LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+		count = len(names)
+	}
+
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "GITORIOUS_LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+
+	for i := 0; i < count; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+
+		// systemd names sockets after the socket unit by default
+		if i == 0 && name != adminSocketName && name != statsdSocketName {
+			name = httpSocketName
+		}
+
+		fd := 3 + i
+		syscall.CloseOnExec(fd)
+		sockets[name] = os.NewFile(uintptr(fd), name)
+	}
+
+	return sockets
+}
+
+// fileConn is implemented by listeners and connections which can be handed
+// off to another process.
+type fileConn interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+// server serves HTTP requests, shutting down gracefully on SIGTERM, handing its
+// sockets off to a new process on SIGHUP, reopening access log on SIGUSR1 and
+// reloading TLS certificates on SIGUSR2.
+type server struct {
+	logger          *log.Logger
+	shutdownTimeout time.Duration
+	inherited       map[string]*os.File
+	certs           *certReloader // nil without TLS
+	accessLog       *accessLog    // nil when not written
+
+	http    *http.Server
+	admin   *http.Server
+	names   []string // of sockets, in the order they're handed off
+	sockets map[string]fileConn
+}
+
+func newServer(logger *log.Logger, shutdownTimeout time.Duration) *server {
+	return &server{
+		logger:          logger,
+		shutdownTimeout: shutdownTimeout,
+		inherited:       inheritedSockets(),
+		sockets:         make(map[string]fileConn),
+	}
+}
+
+func (s *server) add(name string, socket fileConn) {
+	s.names = append(s.names, name)
+	s.sockets[name] = socket
+}
+
+// listen returns the inherited listener with the given name, or listens on
+// addr.
+func (s *server) listen(name, addr string) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+
+	if file, ok := s.inherited[name]; ok {
+		s.logger.Printf("using inherited %v socket", name)
+		listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.add(name, listener.(fileConn))
+
+	return listener, nil
+}
+
+// listenPacket is like listen, for StatsD datagrams.
+func (s *server) listenPacket(name, addr string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+
+	if file, ok := s.inherited[name]; ok {
+		s.logger.Printf("using inherited %v socket", name)
+		conn, err = net.FilePacketConn(file)
+		file.Close()
+	} else {
+		conn, err = common.ListenStatsd(addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.add(name, conn.(fileConn))
+
+	return conn, nil
+}
+
+func (s *server) serve(srv *http.Server, listener net.Listener) {
+	var err error
+
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(listener, "", "") // with HTTP/2
+	} else {
+		err = srv.Serve(listener)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// run serves until the process is told to stop.
+func (s *server) run() {
+	go s.serve(s.http, s.sockets[httpSocketName].(net.Listener))
+
+	if s.admin != nil {
+		go s.serve(s.admin, s.sockets[adminSocketName].(net.Listener))
+	}
+
+	notifyReady()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			s.reopenAccessLog()
+			continue
+		case syscall.SIGUSR2:
+			s.reloadCertificates()
+			continue
+		case syscall.SIGHUP:
+			if err := s.handoff(); err != nil {
+				s.logger.Printf("%v, not restarting", err)
+				continue
+			}
+		default:
+			sdNotify("STOPPING=1")
+		}
+
+		s.shutdown()
+		return
+	}
+}
+
+func (s *server) reloadCertificates() {
+	if s.certs == nil {
+		return
+	}
+
+	if err := s.certs.reload(); err != nil {
+		s.logger.Printf("%v, keeping current certificate", err)
+		return
+	}
+
+	s.logger.Printf("reloaded TLS certificate from %v", s.certs.certFile)
+}
+
+func (s *server) reopenAccessLog() {
+	if s.accessLog == nil {
+		return
+	}
+
+	if err := s.accessLog.reopen(); err != nil {
+		s.logger.Printf("%v, writing access log to the old file", err)
+		return
+	}
+
+	s.logger.Printf("reopened access log %v", s.accessLog.path)
+}
+
+// shutdown stops accepting connections and waits for requests in progress
+// (and git processes serving them) to finish, up to shutdownTimeout.
+func (s *server) shutdown() {
+	s.logger.Printf("shutting down, waiting up to %v for %v git processes in flight...", s.shutdownTimeout, atomic.LoadInt64(&gitProcessesInFlight))
+
+	// after a handoff, metrics are collected and served by the new process
+	if s.admin != nil {
+		s.admin.Close()
+	}
+
+	if socket, ok := s.sockets[statsdSocketName]; ok {
+		socket.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	if err := s.http.Shutdown(ctx); err != nil {
+		s.logger.Printf("%v, closing remaining connections", err)
+		s.http.Close()
+	}
+
+	s.logger.Printf("done")
+}
+
+// handoff starts a new process (possibly a new binary installed at the same
+// path) with our sockets and waits until it's ready to serve.
+func (s *server) handoff() error {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, name := range s.names {
+		file, err := s.sockets[name].File()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, file)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	var env []string
+	for _, envVar := range os.Environ() {
+		if !strings.HasPrefix(envVar, "GITORIOUS_LISTEN_FDNAMES=") && !strings.HasPrefix(envVar, "GITORIOUS_READY_FD=") {
+			env = append(env, envVar)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(env,
+		"GITORIOUS_LISTEN_FDNAMES="+strings.Join(s.names, ":"),
+		fmt.Sprintf("GITORIOUS_READY_FD=%v", 3+len(files)))
+
+	s.logger.Printf("starting new process to hand off sockets to...")
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	go cmd.Wait() // the new process outlives us
+
+	ready.SetReadDeadline(time.Now().Add(handoffTimeout))
+
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		return errors.New(fmt.Sprintf("new process %v didn't become ready: %v", cmd.Process.Pid, err))
+	}
+
+	s.logger.Printf("handed off sockets to process %v", cmd.Process.Pid)
+
+	return nil
+}
+
+// notifyReady tells the process which started us (on SIGHUP) or systemd
+// that we're serving requests.
+func notifyReady() {
+	if fd, err := strconv.Atoi(os.Getenv("GITORIOUS_READY_FD")); err == nil {
+		os.Unsetenv("GITORIOUS_READY_FD")
+
+		ready := os.NewFile(uintptr(fd), "ready")
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+
+	// the main process changes on SIGHUP, which requires NotifyAccess=all
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%v", os.Getpid()))
+}
+
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(state))
+}
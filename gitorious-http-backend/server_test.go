@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	server := newServer(log.New(ioutil.Discard, "", 0), time.Minute)
+
+	listener, err := server.listen(httpSocketName, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan bool)
+	finish := make(chan bool)
+
+	server.http = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-finish
+		w.Write([]byte("done"))
+	})}
+	go server.serve(server.http, listener)
+
+	responses := make(chan *http.Response)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- res
+	}()
+
+	<-started
+
+	stopped := make(chan bool)
+	go func() {
+		server.shutdown()
+		stopped <- true
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatalf("expected shutdown to wait for request in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Errorf("expected new connections to be refused")
+	}
+
+	close(finish)
+
+	if res := <-responses; res == nil || res.StatusCode != 200 {
+		t.Errorf("expected request in progress to finish, got %v", res)
+	}
+
+	<-stopped
+}
+
+func TestSdNotify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "notify")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	sdNotify("READY=1")
+
+	buf := make([]byte, 64)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf(`expected "READY=1", got %q`, buf[:n])
+	}
+}
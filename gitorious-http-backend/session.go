@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+// responseWriter remembers response status and counts bytes written.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	count  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.count += int64(n)
+
+	return n, err
+}
+
+type countingBody struct {
+	common.CountingReader
+	io.Closer
+}
+
+// session collects information about the request for the summary record
+// and the access log entry written when it's handled.
+type session struct {
+	logger       common.StructuredLogger
+	metrics      *httpMetrics
+	accessLog    *accessLog
+	req          *http.Request
+	start        time.Time
+	username     string
+	repoPath     string
+	repositoryId int
+	command      string
+	service      string // metrics label, see metricsService
+	auth         string // authentication outcome
+	err          error
+	w            *responseWriter
+	body         *countingBody
+}
+
+// newSession wraps response writer and request body of the request to
+// collect its stats.
+func newSession(logger common.StructuredLogger, metrics *httpMetrics, accessLog *accessLog, w http.ResponseWriter, req *http.Request) *session {
+	s := &session{
+		logger:    logger,
+		metrics:   metrics,
+		accessLog: accessLog,
+		req:       req,
+		start:     time.Now(),
+		command:   req.Method + " " + req.URL.Path,
+		service:   "other",
+		auth:      authAnonymous,
+		w:         &responseWriter{ResponseWriter: w},
+		body:      &countingBody{common.CountingReader{Reader: req.Body}, req.Body},
+	}
+
+	req.Body = s.body
+
+	return s
+}
+
+func (s *session) summary() []common.Field {
+	return []common.Field{
+		common.User(s.username),
+		common.Repo(s.repoPath),
+		common.Protocol("http"),
+		common.Command(s.command),
+		common.Duration(time.Since(s.start)),
+		common.BytesIn(s.body.Count),
+		common.BytesOut(s.w.count),
+		common.Status(s.w.status),
+		common.Err(s.err),
+	}
+}
+
+func (s *session) finish() {
+	s.logger.Log("request finished", s.summary()...)
+	s.metrics.observe(s.service, s.w.status, s.auth, time.Since(s.start))
+
+	if err := s.accessLog.write(s, s.req); err != nil {
+		s.logger.Printf("%v, access log entry lost", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+// generateCert creates a certificate signed by parent, self-signed when
+// parent is nil.
+func generateCert(t *testing.T, commonName string, isCa bool, parent *testCert) *testCert {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Gitorious"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCa,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCa {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	}
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func writeCert(dir string, cert *testCert) (string, string) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, cert.certPem, 0644)
+	ioutil.WriteFile(keyFile, cert.keyPem, 0600)
+
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	first := generateCert(t, "first", false, nil)
+	certFile, keyFile := writeCert(dir, first)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := generateCert(t, "second", false, nil)
+	writeCert(dir, second)
+
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := reloader.getCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], second.cert.Raw) {
+		t.Errorf("expected reloaded certificate to be served")
+	}
+
+	ioutil.WriteFile(certFile, []byte("garbage"), 0644)
+
+	if err := reloader.reload(); err == nil {
+		t.Errorf("expected error for invalid certificate")
+	}
+
+	cert, _ = reloader.getCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], second.cert.Raw) {
+		t.Errorf("expected current certificate to be kept when reloading fails")
+	}
+}
+
+type testCertificatesApi map[string]string // subject -> username
+
+func (a testCertificatesApi) FindCertificateUser(subject string) (*api.User, error) {
+	if username, ok := a[subject]; ok {
+		return &api.User{Username: username}, nil
+	}
+
+	return nil, nil
+}
+
+func TestHandler_ServeHTTP_ClientCertificate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+
+	ca := generateCert(t, "Gitorious CA", true, nil)
+	serverCert := generateCert(t, "localhost", false, ca)
+	certFile, keyFile := writeCert(dir, serverCert)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, ca.certPem, 0644)
+
+	var buf bytes.Buffer
+	handler := &Handler{
+		logger:          log.New(&buf, "", 0),
+		internalApi:     &testInternalApi{Err: &api.HttpError{StatusCode: 404}},
+		certificatesApi: testCertificatesApi{"CN=sickill,O=Gitorious": "sickill"},
+	}
+
+	server := newServer(log.New(ioutil.Discard, "", 0), time.Second)
+	server.certs, _ = newCertReloader(certFile, keyFile)
+	server.http = &http.Server{Handler: handler}
+
+	config, err := newTlsConfig(server.certs, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.http.TLSConfig = config
+
+	listener, err := server.listen(httpSocketName, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serve(server.http, listener)
+	defer server.shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	var tests = []struct {
+		clientCert     *testCert
+		expectedStatus int
+		expectedLog    string
+	}{
+		{generateCert(t, "sickill", false, ca), 404, "user authenticated as sickill with client certificate CN=sickill,O=Gitorious"},
+		{generateCert(t, "nobody", false, ca), 401, "no user for client certificate CN=nobody,O=Gitorious"},
+		{nil, 404, ""},
+	}
+
+	for _, test := range tests {
+		buf.Reset()
+
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if test.clientCert != nil {
+			tlsConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{test.clientCert.cert.Raw}, PrivateKey: test.clientCert.key}}
+		}
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+
+		res, err := client.Get("https://" + listener.Addr().String() + "/foo/bar.git/info/refs?service=git-upload-pack")
+		if err != nil {
+			t.Errorf("unexpected error %v (%v)", err, test)
+			continue
+		}
+		res.Body.Close()
+
+		if res.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2, got %v (%v)", res.Proto, test)
+		}
+
+		if res.StatusCode != test.expectedStatus {
+			t.Errorf("expected status %v, got %v (%v)", test.expectedStatus, res.StatusCode, test)
+		}
+
+		if !strings.Contains(buf.String(), test.expectedLog) {
+			t.Errorf("expected log to contain %q, got %q (%v)", test.expectedLog, buf.String(), test)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+// the same restrictions as for keys in .authorized_keys file generated by
+// Gitorious, gitorious-shell being the only thing users can run
+const keyOptions = "no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty"
+
+// usernames end up in the command line run by sshd
+var usernameRegexp = regexp.MustCompile("^[a-zA-Z0-9._@+-]+$")
+
+func getLogger(logfilePath, fingerprint string) common.Logger {
+	var writer io.Writer
+
+	writer, err := os.OpenFile(logfilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		writer = ioutil.Discard
+	}
+
+	targetLogger := log.New(writer, "", log.LstdFlags)
+	return &common.SessionLogger{Target: targetLogger, SessionId: fingerprint}
+}
+
+// fingerprint returns SHA256 fingerprint of "<type> <base64 encoded key>", in
+// the format used by sshd for %f token.
+func fingerprint(key string) (string, error) {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return "", errors.New(fmt.Sprintf(`invalid key "%v"`, key))
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(blob)
+
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+func formatAuthorizedKey(shellPath string, sshKey *api.SshKey) (string, error) {
+	if !usernameRegexp.MatchString(sshKey.Username) {
+		return "", errors.New(fmt.Sprintf(`invalid username "%v"`, sshKey.Username))
+	}
+
+	fields := strings.Fields(sshKey.Key)
+	if len(fields) < 2 {
+		return "", errors.New(fmt.Sprintf(`invalid key "%v"`, sshKey.Key))
+	}
+
+	return fmt.Sprintf(`command="%v %v",%v %v %v`, shellPath, sshKey.Username, keyOptions, fields[0], fields[1]), nil
+}
+
+// lookupKey returns authorized_keys line for the key with the given
+// fingerprint, or empty string if the key is unknown.
+func lookupKey(keysApi api.KeysApi, shellPath, keyFingerprint string, logger common.Logger) (string, error) {
+	sshKey, err := keysApi.FindSshKey(keyFingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	if sshKey == nil {
+		logger.Printf("unknown key")
+		return "", nil
+	}
+
+	// don't let the API authorize a different key than the one being offered
+	if strings.HasPrefix(keyFingerprint, "SHA256:") {
+		actual, err := fingerprint(sshKey.Key)
+		if err != nil {
+			return "", err
+		}
+
+		if actual != keyFingerprint {
+			return "", errors.New(fmt.Sprintf("key returned by the API has fingerprint %v", actual))
+		}
+	}
+
+	line, err := formatAuthorizedKey(shellPath, sshKey)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Printf("key belongs to %v", sshKey.Username)
+
+	return line, nil
+}
+
+func main() {
+	var (
+		internalApiUrl    = flag.String("api-url", common.Getenv("GITORIOUS_INTERNAL_API_URL", "http://localhost:3000/api/internal"), "Gitorious internal API URL")
+		apiConnectTimeout = flag.Duration("api-connect-timeout", api.DefaultConnectTimeout, "Timeout for connecting to Gitorious internal API")
+		apiReadTimeout    = flag.Duration("api-read-timeout", api.DefaultReadTimeout, "Timeout for reading Gitorious internal API response")
+		apiSecretFile     = flag.String("api-secret-file", os.Getenv("GITORIOUS_INTERNAL_API_SECRET_FILE"), "File with a key for signing Gitorious internal API requests")
+		apiRetries        = flag.Int("api-retries", api.DefaultMaxRetries, "How many times to retry failed Gitorious internal API requests")
+		shellPath         = flag.String("shell", "gitorious-shell", "Path to gitorious-shell")
+		logfilePath       = flag.String("logfile", common.Getenv("LOGFILE", "/var/log/gitorious/gitorious-keys.log"), "Log file")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [options] <key fingerprint>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	keyFingerprint := flag.Arg(0)
+	logger := getLogger(*logfilePath, keyFingerprint)
+
+	logger.Printf("looking up key")
+
+	signingKey, err := api.LoadSigningKey(*apiSecretFile)
+	if err != nil {
+		logger.Printf("%v, aborting...", err)
+		os.Exit(1)
+	}
+
+	internalApi := api.NewGitoriousInternalApi(*internalApiUrl)
+	internalApi.ConnectTimeout = *apiConnectTimeout
+	internalApi.ReadTimeout = *apiReadTimeout
+	internalApi.MaxRetries = *apiRetries
+	internalApi.SigningKey = signingKey
+
+	line, err := lookupKey(internalApi, *shellPath, keyFingerprint, logger)
+	if err != nil {
+		logger.Printf("%v, aborting...", err)
+		os.Exit(1)
+	}
+
+	if line != "" {
+		fmt.Println(line)
+	}
+
+	logger.Printf("done")
+}
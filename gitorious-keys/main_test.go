@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+const (
+	testKey            = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOD3lH2A5zeB08LD3Qy/lKCSWNt9CLDRXbLRbip/AoFv"
+	testKeyFingerprint = "SHA256:SfmYOiCiGBBF9BeDpT+YDD5Ug8dDrw51LF1zqRXef6M" // as printed by ssh-keygen -l
+)
+
+func TestFingerprint(t *testing.T) {
+	actual, err := fingerprint(testKey + " sickill@laptop")
+
+	if err != nil || actual != testKeyFingerprint {
+		t.Errorf("expected fingerprint %v, got %v (error: %v)", testKeyFingerprint, actual, err)
+	}
+
+	if _, err := fingerprint("ssh-ed25519"); err == nil {
+		t.Errorf("expected error for invalid key")
+	}
+}
+
+type testKeysApi struct {
+	sshKey *api.SshKey
+	err    error
+}
+
+func (a *testKeysApi) FindSshKey(fingerprint string) (*api.SshKey, error) {
+	return a.sshKey, a.err
+}
+
+func TestLookupKey(t *testing.T) {
+	logger := &common.SessionLogger{Target: log.New(ioutil.Discard, "", 0), SessionId: "test"}
+
+	var tests = []struct {
+		sshKey        *api.SshKey
+		err           error
+		fingerprint   string
+		expectedLine  string
+		expectedError bool
+	}{
+		{&api.SshKey{Username: "sickill", Key: testKey + " sickill@laptop"}, nil, testKeyFingerprint, `command="/usr/bin/gitorious-shell sickill",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty ` + testKey, false},
+		{&api.SshKey{Username: "sickill", Key: testKey}, nil, "MD5:8f:12:ab", `command="/usr/bin/gitorious-shell sickill",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty ` + testKey, false},
+		{nil, nil, testKeyFingerprint, "", false},
+		{&api.SshKey{Username: "sickill", Key: testKey}, nil, "SHA256:otherkey", "", true},
+		{&api.SshKey{Username: `sickill" evil`, Key: testKey}, nil, testKeyFingerprint, "", true},
+		{&api.SshKey{Username: "sickill", Key: "ssh-ed25519"}, nil, "MD5:8f:12:ab", "", true},
+		{nil, errors.New("connection refused"), testKeyFingerprint, "", true},
+	}
+
+	for _, test := range tests {
+		line, err := lookupKey(&testKeysApi{test.sshKey, test.err}, "/usr/bin/gitorious-shell", test.fingerprint, logger)
+
+		if line != test.expectedLine {
+			t.Errorf("expected line %q, got %q (%v)", test.expectedLine, line, test)
+		}
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("expected error %v, got %v (%v)", test.expectedError, err, test)
+		}
+	}
+}
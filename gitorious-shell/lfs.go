@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+const defaultLfsTokenTtl = 5 * time.Minute
+
+// git-lfs quotes the path only when it needs to
+var lfsAuthenticateRegexp = regexp.MustCompile("^git-lfs-authenticate\\s+(?:'/?([^']+)'|/?([^'\\s]+))\\s+(upload|download)$")
+
+func isLfsAuthenticateCommand(fullCommand string) bool {
+	return strings.HasPrefix(fullCommand, "git-lfs-authenticate ")
+}
+
+func parseLfsAuthenticateCommand(fullCommand string) (string, string, error) {
+	matches := lfsAuthenticateRegexp.FindStringSubmatch(fullCommand)
+	if matches == nil {
+		return "", "", errors.New(fmt.Sprintf(`invalid git-lfs-authenticate command "%v"`, fullCommand))
+	}
+
+	repoPath := matches[1]
+	if repoPath == "" {
+		repoPath = matches[2]
+	}
+
+	return repoPath, matches[3], nil
+}
+
+type lfsAuthenticateResponse struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header"`
+	ExpiresIn int               `json:"expires_in"`
+}
+
+// lfsOperationAllowed tells whether a token for the operation can be issued.
+// Uploads require write access reported explicitly, as no hook runs for them
+// (unlike for pushes, which are authorized by pre-receive hook when access
+// level is unknown).
+func lfsOperationAllowed(operation string, repoConfig *api.RepoConfig) bool {
+	return operation != "upload" || repoConfig.AccessLevel.CanWrite()
+}
+
+// createLfsAuthenticateResponse returns JSON git-lfs expects from
+// git-lfs-authenticate, pointing it to gitorious-http-backend's LFS endpoints
+// with a token valid for ttl.
+func createLfsAuthenticateResponse(key []byte, username, operation string, repoConfig *api.RepoConfig, now time.Time, ttl time.Duration) ([]byte, error) {
+	if repoConfig.HttpCloneUrl == "" {
+		return nil, errors.New("repository has no HTTP clone URL")
+	}
+
+	cloneUrl, err := url.Parse(repoConfig.HttpCloneUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	// the token is checked against the path requested from gitorious-http-backend
+	token, err := (&common.LfsToken{
+		Username:  username,
+		RepoPath:  strings.Trim(cloneUrl.Path, "/"),
+		Operation: operation,
+		ExpiresAt: now.Add(ttl).Unix(),
+	}).Sign(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&lfsAuthenticateResponse{
+		Href:      strings.TrimSuffix(repoConfig.HttpCloneUrl, "/") + "/info/lfs",
+		Header:    map[string]string{"Authorization": common.LfsTokenScheme + " " + token},
+		ExpiresIn: int(ttl.Seconds()),
+	})
+}
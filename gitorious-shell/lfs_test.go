@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+func TestParseLfsAuthenticateCommand(t *testing.T) {
+	var tests = []struct {
+		fullCommand       string
+		expectedPath      string
+		expectedOperation string
+		expectedError     bool
+	}{
+		{"git-lfs-authenticate 'the/path.git' download", "the/path.git", "download", false},
+		{"git-lfs-authenticate '/the/path.git' upload", "the/path.git", "upload", false},
+		{"git-lfs-authenticate the/path.git upload", "the/path.git", "upload", false},
+		{"git-lfs-authenticate  /the/path.git  download", "the/path.git", "download", false},
+		{"git-lfs-authenticate 'the/path.git' delete", "", "", true},
+		{"git-lfs-authenticate 'the/path.git'", "", "", true},
+		{"git-lfs-authenticate '' upload", "", "", true},
+		{"git-lfs-authenticate the/path.git upload; rm -rf /", "", "", true},
+	}
+
+	for _, test := range tests {
+		path, operation, err := parseLfsAuthenticateCommand(test.fullCommand)
+
+		if path != test.expectedPath {
+			t.Errorf("expected path %v, got %v (%v)", test.expectedPath, path, test)
+		}
+
+		if operation != test.expectedOperation {
+			t.Errorf("expected operation %v, got %v (%v)", test.expectedOperation, operation, test)
+		}
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("expected error %v (%v)", test.expectedError, test)
+		}
+	}
+}
+
+func TestLfsOperationAllowed(t *testing.T) {
+	var tests = []struct {
+		operation   string
+		accessLevel api.AccessLevel
+		expected    bool
+	}{
+		{"download", api.AccessRead, true},
+		{"download", api.AccessUnknown, true},
+		{"upload", api.AccessRead, false},
+		{"upload", api.AccessUnknown, false},
+		{"upload", api.AccessWrite, true},
+		{"upload", api.AccessAdmin, true},
+	}
+
+	for _, test := range tests {
+		allowed := lfsOperationAllowed(test.operation, &api.RepoConfig{AccessLevel: test.accessLevel})
+
+		if allowed != test.expected {
+			t.Errorf("expected %v, got %v (%v)", test.expected, allowed, test)
+		}
+	}
+}
+
+func TestCreateLfsAuthenticateResponse(t *testing.T) {
+	key := []byte("s3cr3t")
+	now := time.Unix(1400000000, 0)
+	repoConfig := &api.RepoConfig{HttpCloneUrl: "https://gitorious.example.com/foo/bar.git"}
+
+	data, err := createLfsAuthenticateResponse(key, "sickill", "upload", repoConfig, now, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var response lfsAuthenticateResponse
+	json.Unmarshal(data, &response)
+
+	if response.Href != "https://gitorious.example.com/foo/bar.git/info/lfs" {
+		t.Errorf("unexpected href %v", response.Href)
+	}
+
+	if response.ExpiresIn != 300 {
+		t.Errorf("expected expires_in 300, got %v", response.ExpiresIn)
+	}
+
+	authorization := response.Header["Authorization"]
+	if !strings.HasPrefix(authorization, "RemoteAuth ") {
+		t.Fatalf(`expected "RemoteAuth" authorization header, got %q`, authorization)
+	}
+
+	token, err := common.VerifyLfsToken(key, strings.TrimPrefix(authorization, "RemoteAuth "), now)
+	if err != nil {
+		t.Fatalf("expected token verifiable with the same key, got %v", err)
+	}
+
+	if token.Username != "sickill" || !token.Allows("foo/bar.git", "upload") {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	if _, err := createLfsAuthenticateResponse(key, "sickill", "upload", &api.RepoConfig{}, now, time.Minute); err == nil {
+		t.Errorf("expected error for repository without HTTP clone URL")
+	}
+}
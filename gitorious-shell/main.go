@@ -6,12 +6,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"gitorious.org/gitorious/gitorious-proto/api"
 	"gitorious.org/gitorious/gitorious-proto/common"
@@ -33,11 +33,15 @@ func parseGitShellCommand(fullCommand string) (string, string, error) {
 	return matches[1], matches[4], nil
 }
 
+func isPushCommand(command string) bool {
+	return strings.HasSuffix(command, "receive-pack")
+}
+
 func formatGitShellCommand(command, repoPath string) string {
 	return fmt.Sprintf("%v '%v'", command, repoPath)
 }
 
-func getLogger(logfilePath, clientId string) common.Logger {
+func getLogger(logfilePath, logFormat, clientId string) *common.SessionLogger {
 	var writer io.Writer
 
 	writer, err := os.OpenFile(logfilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -45,12 +49,51 @@ func getLogger(logfilePath, clientId string) common.Logger {
 		writer = ioutil.Discard
 	}
 
-	targetLogger := log.New(writer, "", log.LstdFlags)
-	return &common.SessionLogger{targetLogger, clientId}
+	format, err := common.ParseLogFormat(logFormat)
+	if err != nil {
+		format = common.LogFormatText
+	}
+
+	targetLogger := common.NewTargetLogger(writer, format)
+	return &common.SessionLogger{Target: targetLogger, SessionId: clientId, Format: format}
+}
+
+// getLimiter returns a limiter configured with GITORIOUS_MAX_PER_* and
+// GITORIOUS_RATE* environment variables, shared with other gitorious-shell
+// processes through files in GITORIOUS_LIMITS_DIR. It's nil when no limits
+// are set.
+func getLimiter(logger common.Logger) common.Limiter {
+	limits := common.Limits{
+		MaxPerUser: common.GetenvInt("GITORIOUS_MAX_PER_USER", 0),
+		MaxPerIp:   common.GetenvInt("GITORIOUS_MAX_PER_IP", 0),
+		MaxPerRepo: common.GetenvInt("GITORIOUS_MAX_PER_REPO", 0),
+		Rate:       common.GetenvFloat("GITORIOUS_RATE", 0),
+		Burst:      common.GetenvInt("GITORIOUS_RATE_BURST", 10),
+	}
+
+	if !limits.Enabled() {
+		return nil
+	}
+
+	limiter, err := common.NewFileLimiter(limits, common.Getenv("GITORIOUS_LIMITS_DIR", "/var/run/gitorious/limits"))
+	if err != nil {
+		logger.Printf("%v, not enforcing limits", err)
+		return nil
+	}
+
+	return limiter
 }
 
-func createSshEnv(username string, repoConfig *api.RepoConfig) []string {
-	return common.CreateEnv("ssh", username, repoConfig)
+// clientIp returns client IP from SSH_CLIENT ("<ip> <port> <local port>").
+func clientIp(sshClient string) string {
+	return strings.Fields(sshClient)[0]
+}
+
+// createSshEnv passes gitProtocol (as forwarded by sshd with "AcceptEnv
+// GIT_PROTOCOL") to git, so the client can negotiate protocol v2.
+func createSshEnv(username string, repoConfig *api.RepoConfig, gitProtocol string) []string {
+	env := common.CreateEnv("ssh", username, repoConfig)
+	return common.AppendGitProtocol(env, gitProtocol)
 }
 
 func execGitShell(command string, env []string, stdin io.Reader, stdout io.Writer) (string, error) {
@@ -60,6 +103,10 @@ func execGitShell(command string, env []string, stdin io.Reader, stdout io.Write
 	cmd.Stdout = stdout
 	var stderrBuf bytes.Buffer
 	cmd.Stderr = &stderrBuf
+	// don't wait for the client to close its end of the connection after
+	// git-shell is done when stdin is not a file (Run returns
+	// exec.ErrWaitDelay then, if git-shell succeeded)
+	cmd.WaitDelay = time.Second
 
 	if err := cmd.Run(); err != nil {
 		return strings.Trim(stderrBuf.String(), " \n"), err
@@ -68,25 +115,166 @@ func execGitShell(command string, env []string, stdin io.Reader, stdout io.Write
 	return "", nil
 }
 
+// getRepoConfig fetches the repository config, exiting with a message for the
+// user when it's not available.
+func getRepoConfig(internalApi api.InternalApi, repoPath, username string, s *session) *api.RepoConfig {
+	logger := s.logger
+
+	repoConfig, err := internalApi.GetRepoConfig(repoPath, username)
+	if err != nil {
+		if httpErr, ok := err.(*api.HttpError); ok {
+			if httpErr.StatusCode == 403 {
+				say("Access denied")
+				logger.Printf("%v, aborting...", err)
+				s.abort(reasonAccessDenied, err)
+			} else if httpErr.StatusCode == 404 {
+				say("Invalid repository path")
+				logger.Printf("%v, aborting...", err)
+				s.abort(reasonNotFound, err)
+			}
+		}
+
+		if _, ok := err.(*api.UnavailableError); ok {
+			say("Service temporarily unavailable, please try again later")
+			logger.Printf("%v, aborting...", err)
+			s.abort(reasonUnavailable, err)
+		}
+
+		say("Error occured, please contact support")
+		logger.Printf("%v, aborting...", err)
+		s.abort(reasonError, err)
+	}
+
+	s.repositoryId = repoConfig.RepositoryId
+
+	return repoConfig
+}
+
+// acquireLimit takes a slot for the session, exiting with a message for the
+// user when a limit is reached.
+func acquireLimit(limiter common.Limiter, key common.LimitKey, s *session) func() {
+	logger := s.logger
+
+	release, err := limiter.Acquire(key)
+	if err != nil {
+		if limitErr, ok := err.(*common.LimitError); ok {
+			if limitErr.RateLimited {
+				say("Too many requests, please try again later")
+			} else {
+				say("Too many concurrent operations, please try again later")
+			}
+
+			logger.Printf("%v, aborting...", err)
+			s.abort(reasonLimited, err)
+		}
+
+		say("Error occured, please contact support")
+		logger.Printf("%v, aborting...", err)
+		s.abort(reasonError, err)
+	}
+
+	return release
+}
+
+func lfsAuthenticate(internalApi *api.GitoriousInternalApi, username, sshCommand string, maintenance *common.Maintenance, s *session) {
+	logger := s.logger
+
+	repoPath, operation, err := parseLfsAuthenticateCommand(sshCommand)
+	if err != nil {
+		say("Invalid command")
+		logger.Printf("%v, aborting...", err)
+		s.abort(reasonInvalidCommand, err)
+	}
+
+	s.repoPath = repoPath
+	s.command = "git-lfs-authenticate " + operation
+
+	if maintenance.Rejects(operation == "upload") {
+		say("%v", maintenance.Message)
+		logger.Printf("%v maintenance mode, denying LFS upload, aborting...", maintenance.Mode)
+		s.abort(reasonMaintenance, errors.New("maintenance mode"))
+	}
+
+	repoConfig := getRepoConfig(internalApi, repoPath, username, s)
+
+	logger.Printf("full repo path: %v", repoConfig.FullPath)
+
+	if !lfsOperationAllowed(operation, repoConfig) {
+		say("You don't have write access to this repository")
+		logger.Printf(`%v has "%v" access level, denying LFS upload, aborting...`, username, repoConfig.AccessLevel)
+		s.abort(reasonWriteDenied, errors.New("write access denied"))
+	}
+
+	if internalApi.SigningKey == nil {
+		say("Git LFS is not enabled on this server")
+		logger.Printf("no key for signing LFS tokens (internal API secret is not set), aborting...")
+		s.abort(reasonError, errors.New("no key for signing LFS tokens"))
+	}
+
+	ttl := common.GetenvDuration("GITORIOUS_LFS_TOKEN_TTL", defaultLfsTokenTtl)
+
+	response, err := createLfsAuthenticateResponse(internalApi.SigningKey, username, operation, repoConfig, time.Now(), ttl)
+	if err != nil {
+		say("Git LFS is not enabled on this server")
+		logger.Printf("%v, aborting...", err)
+		s.abort(reasonError, err)
+	}
+
+	s.stdout.Write(response)
+
+	logger.Printf("issued LFS %v token valid for %v", operation, ttl)
+	logger.Printf("done")
+	s.finish(0, reasonOk, nil)
+}
+
 func main() {
 	syscall.Umask(0022) // set umask for pushes
 
 	clientId := common.Getenv("SSH_CLIENT", "local")
 	logfilePath := common.Getenv("LOGFILE", "/var/log/gitorious/gitorious-shell.log")
-	internalApiUrl := common.Getenv("GITORIOUS_INTERNAL_API_URL", "http://localhost:3000/api/internal")
-
-	logger := getLogger(logfilePath, clientId)
-	internalApi := &api.GitoriousInternalApi{internalApiUrl}
+	logFormat := common.Getenv("LOG_FORMAT", "text")
+
+	logger := getLogger(logfilePath, logFormat, clientId)
+	s := newSession(logger)
+
+	if metricsAddr := os.Getenv("GITORIOUS_METRICS_ADDR"); metricsAddr != "" {
+		metrics, err := common.DialStatsd(metricsAddr)
+		if err != nil {
+			logger.Printf("failed to connect to metrics sink: %v", err)
+		} else {
+			defer metrics.Close()
+			s.metrics = metrics
+		}
+	}
 
 	logger.Printf("client connected")
 
+	maintenance, err := common.ReadMaintenance(common.Getenv("GITORIOUS_MAINTENANCE_FILE", common.DefaultMaintenanceFile))
+	if err != nil {
+		logger.Printf("%v, assuming read-only maintenance mode...", err)
+	}
+
+	if maintenance.Rejects(false) {
+		say("%v", maintenance.Message)
+		logger.Printf("%v maintenance mode, aborting...", maintenance.Mode)
+		s.abort(reasonMaintenance, errors.New("maintenance mode"))
+	}
+
+	internalApi, err := common.NewInternalApiFromEnv()
+	if err != nil {
+		say("Error occured, please contact support")
+		logger.Printf("%v, aborting...", err)
+		s.abort(reasonError, err)
+	}
+
 	if len(os.Args) < 2 {
 		say("Error occured, please contact support")
 		logger.Printf("username argument missing, check .authorized_keys file")
-		os.Exit(1)
+		s.abort(reasonError, errors.New("username argument missing"))
 	}
 
 	username := os.Args[1]
+	s.username = username
 	logger.Printf("user authenticated as %v", username)
 
 	sshCommand := strings.Trim(os.Getenv("SSH_ORIGINAL_COMMAND"), " \n")
@@ -94,56 +282,72 @@ func main() {
 	if sshCommand == "" { // deny regular ssh login attempts
 		say("Hey %v! Sorry, Gitorious doesn't provide shell access. Bye!", username)
 		logger.Printf("SSH_ORIGINAL_COMMAND missing, aborting...")
-		os.Exit(1)
+		s.abort(reasonInvalidCommand, errors.New("SSH_ORIGINAL_COMMAND missing"))
 	}
 
 	logger.Printf("processing command: %v", sshCommand)
 
+	if isLfsAuthenticateCommand(sshCommand) {
+		lfsAuthenticate(internalApi, username, sshCommand, maintenance, s)
+		return
+	}
+
 	command, repoPath, err := parseGitShellCommand(sshCommand)
 	if err != nil {
 		say("Invalid command")
 		logger.Printf("%v, aborting...", err)
-		os.Exit(1)
+		s.abort(reasonInvalidCommand, err)
 	}
 
-	repoConfig, err := internalApi.GetRepoConfig(repoPath, username)
-	if err != nil {
-		if httpErr, ok := err.(*api.HttpError); ok {
-			if httpErr.StatusCode == 403 {
-				say("Access denied")
-				logger.Printf("%v, aborting...", err)
-				os.Exit(1)
-			} else if httpErr.StatusCode == 404 {
-				say("Invalid repository path")
-				logger.Printf("%v, aborting...", err)
-				os.Exit(1)
-			}
-		}
+	s.repoPath = repoPath
+	s.command = command
 
-		say("Error occured, please contact support")
-		logger.Printf("%v, aborting...", err)
-		os.Exit(1)
+	if maintenance.Rejects(isPushCommand(command)) {
+		say("%v", maintenance.Message)
+		logger.Printf("%v maintenance mode, denying push, aborting...", maintenance.Mode)
+		s.abort(reasonMaintenance, errors.New("maintenance mode"))
 	}
 
+	repoConfig := getRepoConfig(internalApi, repoPath, username, s)
+
 	logger.Printf("full repo path: %v", repoConfig.FullPath)
 
+	if isPushCommand(command) && repoConfig.WriteDenied() {
+		say("You don't have write access to this repository")
+		logger.Printf("%v has %v access only, denying push, aborting...", username, repoConfig.AccessLevel)
+		s.abort(reasonWriteDenied, errors.New("write access denied"))
+	}
+
 	if !common.PreReceiveHookExists(repoConfig.FullPath) {
 		say("Error occurred, please contact support")
 		logger.Printf("pre-receive hook for %v is missing or is not executable, aborting...", repoConfig.FullPath)
-		os.Exit(1)
+		s.abort(reasonError, errors.New("pre-receive hook missing"))
+	}
+
+	if limiter := getLimiter(logger); limiter != nil {
+		release := acquireLimit(limiter, common.LimitKey{User: username, Ip: clientIp(clientId), Repo: repoConfig.FullPath}, s)
+		defer release()
 	}
 
 	gitShellCommand := formatGitShellCommand(command, repoConfig.FullPath)
-	env := createSshEnv(username, repoConfig)
+	gitProtocol := os.Getenv("GIT_PROTOCOL")
+	if gitProtocol != "" {
+		logger.Printf("client requested protocol: %v", gitProtocol)
+	}
+
+	env := createSshEnv(username, repoConfig, gitProtocol)
 
 	logger.Printf(`invoking git-shell with command "%v"`, gitShellCommand)
 
-	if stderr, err := execGitShell(gitShellCommand, env, os.Stdin, os.Stdout); err != nil {
+	if stderr, err := execGitShell(gitShellCommand, env, s.stdin, s.stdout); err == exec.ErrWaitDelay {
+		logger.Printf("%v, git-shell succeeded but client didn't close the connection, not waiting for it", err)
+	} else if err != nil {
 		say("Error occurred, please contact support")
 		logger.Printf("error occured in git-shell: %v", err)
 		logger.Printf("stderr: %v", stderr)
-		os.Exit(1)
+		s.abort(reasonGitError, err)
 	}
 
 	logger.Printf("done")
+	s.finish(0, reasonOk, nil)
 }
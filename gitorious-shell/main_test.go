@@ -3,9 +3,15 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"gitorious.org/gitorious/gitorious-proto/api"
+	"gitorious.org/gitorious/gitorious-proto/common"
 )
 
 func TestParseGitShellCommand(t *testing.T) {
@@ -49,6 +55,24 @@ func TestParseGitShellCommand(t *testing.T) {
 	}
 }
 
+func TestIsPushCommand(t *testing.T) {
+	var tests = []struct {
+		command  string
+		expected bool
+	}{
+		{"git-receive-pack", true},
+		{"git receive-pack", true},
+		{"git-upload-pack", false},
+		{"git upload-archive", false},
+	}
+
+	for _, test := range tests {
+		if isPushCommand(test.command) != test.expected {
+			t.Errorf("expected isPushCommand(%q) to be %v", test.command, test.expected)
+		}
+	}
+}
+
 func TestFormatGitShellCommand(t *testing.T) {
 	expected := "git upload-pack '/repo/path.git'"
 	actual := formatGitShellCommand("git upload-pack", "/repo/path.git")
@@ -92,3 +116,61 @@ func TestExecGitShell(t *testing.T) {
 		t.Errorf(`expected output on stderr doesn't match or error is nil, got "%v" on stderr`, stderr)
 	}
 }
+
+// PATH before tests prepended fake git-shell fixtures to it
+var originalPath = os.Getenv("PATH")
+
+func TestExecGitShell_ProtocolV2(t *testing.T) {
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", originalPath)
+	defer os.Setenv("PATH", path)
+
+	fullRepoPath, _ := ioutil.TempDir("", "gitorious-shell")
+	defer os.RemoveAll(fullRepoPath)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = fullRepoPath
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v failed: %v", args, err)
+		}
+
+		return strings.TrimSpace(string(output))
+	}
+
+	git("init", "-q", "--bare", ".")
+	commit := git("commit-tree", git("mktree"), "-m", "initial commit")
+	git("update-ref", "refs/heads/master", commit)
+	git("update-ref", "refs/heads/feature", commit)
+	git("update-ref", "refs/tags/v1.0", commit)
+
+	stdin := &bytes.Buffer{}
+	common.WritePacket(stdin, "command=ls-refs\n")
+	stdin.WriteString("0001") // delimiter packet
+	common.WritePacket(stdin, "ref-prefix refs/heads/\n")
+	common.WriteFlushPacket(stdin)
+	stdout := &bytes.Buffer{}
+
+	env := createSshEnv("sickill", &api.RepoConfig{RepositoryId: 123}, "version=2")
+	command := formatGitShellCommand("git-upload-pack", fullRepoPath)
+
+	if stderr, err := execGitShell(command, env, stdin, stdout); err != nil {
+		t.Fatalf("expected no error, got %v (stderr: %v)", err, stderr)
+	}
+
+	output := stdout.String()
+
+	if !strings.HasPrefix(output, "000eversion 2\n") {
+		t.Errorf("expected protocol v2 capability advertisement, got %q", output)
+	}
+
+	if !strings.Contains(output, " refs/heads/master\n") || !strings.Contains(output, " refs/heads/feature\n") {
+		t.Errorf("expected branches to be listed, got %q", output)
+	}
+
+	if strings.Contains(output, "refs/tags/v1.0") {
+		t.Errorf("expected refs to be filtered by prefix, got %q", output)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+// reasons the session ended, reported in the summary and metrics
+const (
+	reasonOk             = "ok"
+	reasonError          = "error"
+	reasonInvalidCommand = "invalid_command"
+	reasonAccessDenied   = "access_denied"
+	reasonNotFound       = "not_found"
+	reasonUnavailable    = "unavailable"
+	reasonWriteDenied    = "write_denied"
+	reasonLimited        = "limited"
+	reasonMaintenance    = "maintenance"
+	reasonGitError       = "git_error"
+)
+
+// session collects information about the SSH session for the summary record
+// logged when it ends.
+type session struct {
+	logger       common.StructuredLogger
+	metrics      *common.StatsdClient // not reported when nil
+	start        time.Time
+	username     string
+	repoPath     string
+	repositoryId int
+	command      string
+	stdin        *common.CountingReader
+	stdout       *common.CountingWriter
+}
+
+func newSession(logger common.StructuredLogger) *session {
+	return &session{
+		logger: logger,
+		start:  time.Now(),
+		stdin:  &common.CountingReader{Reader: os.Stdin},
+		stdout: &common.CountingWriter{Writer: os.Stdout},
+	}
+}
+
+func (s *session) summary(exitStatus int, reason string, err error) []common.Field {
+	return []common.Field{
+		common.User(s.username),
+		common.Repo(s.repoPath),
+		common.Protocol("ssh"),
+		common.Command(s.command),
+		common.Duration(time.Since(s.start)),
+		common.BytesIn(s.stdin.Count),
+		common.BytesOut(s.stdout.Count),
+		common.ExitStatus(exitStatus),
+		common.ExitReason(reason),
+		common.Err(err),
+	}
+}
+
+// metricsCommand returns git command without "git-"/"git " prefix and
+// arguments, e.g. "upload-pack" or "lfs-authenticate".
+func metricsCommand(command string) string {
+	fields := strings.Fields(command)
+
+	switch {
+	case len(fields) == 0:
+		return "unknown"
+	case fields[0] == "git" && len(fields) > 1:
+		return fields[1]
+	}
+
+	return strings.TrimPrefix(fields[0], "git-")
+}
+
+// sessionMetrics returns metrics reported to the StatsD sink.
+func (s *session) sessionMetrics(reason string) []*common.StatsdMetric {
+	tags := []common.StatsdTag{
+		{Key: "command", Value: metricsCommand(s.command)},
+		{Key: "reason", Value: reason},
+	}
+
+	if s.username != "" {
+		tags = append(tags, common.StatsdTag{Key: "user", Value: s.username})
+	}
+
+	if s.repositoryId != 0 {
+		tags = append(tags, common.StatsdTag{Key: "repository_id", Value: strconv.Itoa(s.repositoryId)})
+	}
+
+	return []*common.StatsdMetric{
+		{Name: "gitorious_ssh_sessions_total", Value: 1, Type: "c", Tags: tags},
+		{Name: "gitorious_ssh_session_duration", Value: float64(time.Since(s.start)) / float64(time.Millisecond), Type: "ms", Tags: tags},
+		{Name: "gitorious_ssh_bytes_in_total", Value: float64(s.stdin.Count), Type: "c", Tags: tags},
+		{Name: "gitorious_ssh_bytes_out_total", Value: float64(s.stdout.Count), Type: "c", Tags: tags},
+	}
+}
+
+func (s *session) finish(exitStatus int, reason string, err error) {
+	s.logger.Log("session finished", s.summary(exitStatus, reason, err)...)
+
+	if s.metrics != nil {
+		if err := s.metrics.Send(s.sessionMetrics(reason)...); err != nil {
+			s.logger.Printf("failed to report metrics: %v", err)
+		}
+	}
+}
+
+// abort ends the session with failure.
+func (s *session) abort(reason string, err error) {
+	s.finish(1, reason, err)
+	os.Exit(1)
+}
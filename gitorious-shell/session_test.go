@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gitorious.org/gitorious/gitorious-proto/common"
+)
+
+func TestMetricsCommand(t *testing.T) {
+	var tests = []struct {
+		command         string
+		expectedCommand string
+	}{
+		{"git-upload-pack", "upload-pack"},
+		{"git upload-pack", "upload-pack"},
+		{"git-receive-pack", "receive-pack"},
+		{"git-lfs-authenticate upload", "lfs-authenticate"},
+		{"", "unknown"},
+	}
+
+	for _, test := range tests {
+		if command := metricsCommand(test.command); command != test.expectedCommand {
+			t.Errorf("expected %v, got %v (%v)", test.expectedCommand, command, test)
+		}
+	}
+}
+
+func TestSession_SessionMetrics(t *testing.T) {
+	s := &session{
+		username:     "sickill",
+		repositoryId: 123,
+		command:      "git-receive-pack",
+		stdin:        &common.CountingReader{Count: 100},
+		stdout:       &common.CountingWriter{Count: 2000},
+	}
+
+	var lines []string
+	for _, metric := range s.sessionMetrics(reasonWriteDenied) {
+		if metric.Name == "gitorious_ssh_session_duration" {
+			metric.Value = 0
+		}
+
+		lines = append(lines, metric.String())
+	}
+
+	expected := strings.Join([]string{
+		"gitorious_ssh_sessions_total:1|c|#command:receive-pack,reason:write_denied,user:sickill,repository_id:123",
+		"gitorious_ssh_session_duration:0|ms|#command:receive-pack,reason:write_denied,user:sickill,repository_id:123",
+		"gitorious_ssh_bytes_in_total:100|c|#command:receive-pack,reason:write_denied,user:sickill,repository_id:123",
+		"gitorious_ssh_bytes_out_total:2000|c|#command:receive-pack,reason:write_denied,user:sickill,repository_id:123",
+	}, "\n")
+
+	if strings.Join(lines, "\n") != expected {
+		t.Errorf("expected:\n%v\ngot:\n%v", expected, strings.Join(lines, "\n"))
+	}
+}